@@ -0,0 +1,303 @@
+package tarka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(new(adminAPI))
+}
+
+// adminAPIPrefix is where the admin API routes live
+const adminAPIPrefix = "/tarka/"
+
+// provisioned holds the providers of the running config, most recently
+// provisioned last, for the admin API to use
+var provisioned struct {
+	sync.Mutex
+	providers []*Provider
+}
+
+// registerProvider makes p available to the admin API
+func registerProvider(p *Provider) {
+	provisioned.Lock()
+	defer provisioned.Unlock()
+	provisioned.providers = append(provisioned.providers, p)
+}
+
+// unregisterProvider removes p from the admin API
+func unregisterProvider(p *Provider) {
+	provisioned.Lock()
+	defer provisioned.Unlock()
+	provisioned.providers = slices.DeleteFunc(provisioned.providers, func(other *Provider) bool { return other == p })
+}
+
+// registeredProviders returns the providers the admin API can use
+func registeredProviders() []*Provider {
+	provisioned.Lock()
+	defer provisioned.Unlock()
+	return slices.Clone(provisioned.providers)
+}
+
+// apiRecord is a record as the admin API reads and writes it
+type apiRecord struct {
+	// Name relative to the zone, with @ for the apex
+	Name string `json:"name"`
+
+	// Type, e.g. A or TXT
+	Type string `json:"type"`
+
+	// TTL in seconds (0 for the provider's default)
+	TTL int `json:"ttl,omitempty"`
+
+	// Data in zone file form, with TXT values unquoted
+	Data string `json:"data"`
+
+	// ID is Tarka's record ID; given, it picks the exact record to change
+	ID string `json:"id,omitempty"`
+}
+
+// adminAPI serves the zones of the provisioned providers on Caddy's admin
+// endpoint, behind its origin checks and remote access controls:
+//
+//	GET    /tarka/zones                 lists the zones
+//	GET    /tarka/zones/{zone}/records  lists a zone's records
+//	POST   /tarka/zones/{zone}/records  adds records (AppendRecords)
+//	PUT    /tarka/zones/{zone}/records  replaces RRsets (SetRecords)
+//	DELETE /tarka/zones/{zone}/records  deletes records (DeleteRecords)
+//
+// Requests with records take and return a JSON array of them. A zone is
+// managed by the first provider whose account holds it; each provider keeps
+// its own session, ledger and locks, so changes made here behave as if Caddy
+// had made them.
+type adminAPI struct {
+	log *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.tarka",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Provision sets up the logger. Implements caddy.Provisioner.
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	a.log = ctx.Logger(a)
+	return nil
+}
+
+// Routes returns the admin API routes. Implements caddy.AdminRouter.
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: adminAPIPrefix,
+		Handler: caddy.AdminHandlerFunc(a.handle),
+	}}
+}
+
+// handle routes requests under adminAPIPrefix
+func (a *adminAPI) handle(w http.ResponseWriter, r *http.Request) error {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminAPIPrefix), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "zones":
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(r)
+		}
+		return a.handleZones(w, r)
+	case len(parts) == 3 && parts[0] == "zones" && parts[1] != "" && parts[2] == "records":
+		return a.handleRecords(w, r, parts[1])
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+	}
+}
+
+// handleZones lists the zones of all the providers
+func (a *adminAPI) handleZones(w http.ResponseWriter, r *http.Request) error {
+	zones := []string{}
+	for _, p := range registeredProviders() {
+		domains, err := p.managedDomains(r.Context())
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+		}
+		for _, domain := range domains {
+			if !slices.Contains(zones, domain.Name) {
+				zones = append(zones, domain.Name)
+			}
+		}
+	}
+	slices.Sort(zones)
+	return writeAPIResponse(w, http.StatusOK, zones)
+}
+
+// handleRecords lists or changes the records of zone
+func (a *adminAPI) handleRecords(w http.ResponseWriter, r *http.Request, zone string) error {
+	p, domainID, err := providerForZone(r.Context(), zone)
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+
+	if r.Method == http.MethodGet {
+		records, err := p.GetRecords(ctx, zone)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+		}
+		return writeAPIResponse(w, http.StatusOK, toAPIRecords(records))
+	}
+
+	var change func(context.Context, string, []libdns.Record) ([]libdns.Record, error)
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodPost:
+		change, status = p.AppendRecords, http.StatusCreated
+	case http.MethodPut:
+		change = p.SetRecords
+	case http.MethodDelete:
+		change = p.DeleteRecords
+	default:
+		return methodNotAllowed(r)
+	}
+
+	var input []apiRecord
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding records: %w", err)}
+	}
+	records, err := fromAPIRecords(input, domainID)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	changed, err := change(ctx, zone, records)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+	}
+	a.log.Info("Changed records through the admin API",
+		zap.String("method", r.Method), zap.String("zone", zone), zap.Int("records", len(changed)))
+	return writeAPIResponse(w, status, toAPIRecords(changed))
+}
+
+// managedDomains returns the account's domains the provider manages: all of
+// them, or only the one with its DomainID if set
+func (p *Provider) managedDomains(ctx context.Context) ([]client.Domain, error) {
+	c, err := p.getClient()
+	if err != nil {
+		return nil, err
+	}
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.DomainID != "" {
+		domains = slices.DeleteFunc(domains, func(domain client.Domain) bool { return domain.ID != p.DomainID })
+	}
+	return domains, nil
+}
+
+// providerForZone returns the first provider managing zone, and the zone's
+// domain ID. Providers that fail to list their domains are skipped, but
+// reported if no provider manages the zone.
+func providerForZone(ctx context.Context, zone string) (*Provider, string, error) {
+	name, err := normalizeZone(zone)
+	if err != nil {
+		return nil, "", caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	var errs []error
+	for _, p := range registeredProviders() {
+		domains, err := p.managedDomains(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, domain := range domains {
+			if domainName, err := normalizeZone(domain.Name); err == nil && domainName == name {
+				return p, domain.ID, nil
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, "", caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: errors.Join(errs...)}
+	}
+	return nil, "", caddy.APIError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("zone %s is not managed by any tarka provider", zone),
+	}
+}
+
+// fromAPIRecords converts records from a request, attaching the IDs given
+func fromAPIRecords(input []apiRecord, domainID string) ([]libdns.Record, error) {
+	records := make([]libdns.Record, 0, len(input))
+	for i, in := range input {
+		if in.Name == "" || in.Type == "" {
+			return nil, fmt.Errorf("record %d needs a name and type", i)
+		}
+		rr := libdns.RR{
+			Name: in.Name,
+			Type: strings.ToUpper(in.Type),
+			TTL:  time.Duration(in.TTL) * time.Second,
+			Data: in.Data,
+		}
+		record, err := rr.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %s %s: %w", in.Name, in.Type, err)
+		}
+		if in.ID != "" {
+			record = withProviderData(record, ProviderData{ID: in.ID, DomainID: domainID})
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// toAPIRecords converts records for a response
+func toAPIRecords(records []libdns.Record) []apiRecord {
+	out := make([]apiRecord, 0, len(records))
+	for _, record := range records {
+		rr := record.RR()
+		rec := apiRecord{Name: rr.Name, Type: rr.Type, TTL: int(rr.TTL.Seconds()), Data: rr.Data}
+		if data, ok := providerDataOf(record); ok {
+			rec.ID = data.ID
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// writeAPIResponse writes v as JSON with the given status
+func writeAPIResponse(w http.ResponseWriter, status int, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	return err
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed: %v", r.Method),
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+	_ caddy.Provisioner = (*adminAPI)(nil)
+)
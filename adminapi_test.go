@@ -0,0 +1,125 @@
+package tarka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nsna/tarka/internal/tarkatest"
+	"go.uber.org/zap"
+)
+
+func TestAdminAPI(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddDomain("124", "example.org")
+	wwwID := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+
+	// Start from a clean registry, as other tests provision providers too
+	provisioned.Lock()
+	saved := provisioned.providers
+	provisioned.providers = nil
+	provisioned.Unlock()
+	defer func() {
+		provisioned.Lock()
+		provisioned.providers = saved
+		provisioned.Unlock()
+	}()
+
+	p := &Provider{Username: tarkatest.Username, Password: tarkatest.Password, BaseURL: server.BaseURL(), DomainID: "123"}
+	ctx, cancel := StandaloneContext(context.Background(), nil)
+	defer cancel()
+	if err := p.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	api := &adminAPI{log: zap.NewNop()}
+	do := func(method, path, body string, out any) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		err := api.handle(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var apiErr caddy.APIError
+		if errors.As(err, &apiErr) {
+			return apiErr.HTTPStatus
+		}
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		if out != nil {
+			if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+				t.Fatalf("failed to decode %s %s: %v", method, path, err)
+			}
+		}
+		return rec.Code
+	}
+
+	// Only the provider's domain is served
+	var zones []string
+	do(http.MethodGet, "/tarka/zones", "", &zones)
+	if !reflect.DeepEqual(zones, []string{"example.com"}) {
+		t.Errorf("expected [example.com], got %v", zones)
+	}
+	if code := do(http.MethodGet, "/tarka/zones/example.org/records", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a zone no provider manages, got %d", code)
+	}
+
+	var records []apiRecord
+	do(http.MethodGet, "/tarka/zones/example.com/records", "", &records)
+	want := []apiRecord{{Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.1", ID: strconv.Itoa(wwwID)}}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("expected %+v, got %+v", want, records)
+	}
+
+	// POST adds
+	if code := do(http.MethodPost, "/tarka/zones/example.com/records", `[{"name":"api","type":"TXT","ttl":300,"data":"hello world"}]`, &records); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if len(records) != 1 || records[0].Data != "hello world" || records[0].ID == "" {
+		t.Fatalf("unexpected created records %+v", records)
+	}
+	created := records[0]
+
+	// PUT replaces the RRset in place
+	if code := do(http.MethodPut, "/tarka/zones/example.com/records", `[{"name":"www","type":"A","ttl":3600,"data":"192.0.2.2"}]`, nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for _, rec := range server.Records("123") {
+		if rec.Name == "www" && (rec.ID != wwwID || rec.Data != "192.0.2.2") {
+			t.Errorf("expected www to be edited in place, got %+v", rec)
+		}
+	}
+
+	// DELETE removes by ID
+	body, _ := json.Marshal([]apiRecord{{Name: created.Name, Type: created.Type, ID: created.ID}})
+	if code := do(http.MethodDelete, "/tarka/zones/example.com/records", string(body), &records); code != http.StatusOK || len(records) != 1 {
+		t.Fatalf("expected the record to be deleted, got %d %+v", code, records)
+	}
+	if n := len(server.Records("123")); n != 1 {
+		t.Errorf("expected 1 record left, got %d", n)
+	}
+
+	// Bad requests
+	if code := do(http.MethodPost, "/tarka/zones/example.com/records", `[{"name":"x","type":"A","data":"not-an-ip"}]`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid record, got %d", code)
+	}
+	if code := do(http.MethodPatch, "/tarka/zones/example.com/records", "[]", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", code)
+	}
+	if code := do(http.MethodGet, "/tarka/other", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+
+	// Cleaned up providers are no longer served
+	p.Cleanup()
+	if code := do(http.MethodGet, "/tarka/zones/example.com/records", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 after cleanup, got %d", code)
+	}
+}
@@ -0,0 +1,275 @@
+package tarka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+// Audit sinks
+const (
+	// AuditSinkFile appends JSON lines to a file
+	AuditSinkFile = "file"
+
+	// AuditSinkLog writes to the dns.providers.tarka.audit logger
+	AuditSinkLog = "log"
+
+	// AuditSinkStorage writes each event to its own key in Caddy's storage
+	AuditSinkStorage = "storage"
+)
+
+// Audit outcomes
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDryRun  = "dry_run"
+)
+
+// AuditConfig makes the provider record every record add, edit and delete
+// it sends to Tarka, whether it succeeds or not
+type AuditConfig struct {
+	// Sink to write events to: file (the default), log or storage
+	Sink string `json:"sink,omitempty"`
+
+	// Path of the file sink, created if missing and only ever appended to
+	Path string `json:"path,omitempty"`
+}
+
+// AuditEvent is one change sent to Tarka, as written to the audit log
+type AuditEvent struct {
+	// Time the change was made
+	Time time.Time `json:"ts"`
+
+	// InstanceID of the Caddy instance that made it
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// Operation is add, edit or delete
+	Operation string `json:"operation"`
+
+	// Zone and DomainID the record is in
+	Zone     string `json:"zone"`
+	DomainID string `json:"domain_id"`
+
+	// Before and After are the record before and after the change, with
+	// Before unset for adds and After unset for deletes
+	Before *AuditRecord `json:"before,omitempty"`
+	After  *AuditRecord `json:"after,omitempty"`
+
+	// Subject of the certificate an ACME challenge record is for
+	Subject string `json:"subject,omitempty"`
+
+	// Outcome is success, failure or dry_run
+	Outcome string `json:"outcome"`
+
+	// Error, for failures
+	Error string `json:"error,omitempty"`
+}
+
+// AuditRecord is a record as written to the audit log. ACME challenge
+// records keep a digest of their data instead, like the ledger, so their
+// tokens don't end up in the log.
+type AuditRecord struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	TTL      int    `json:"ttl,omitempty"`
+	Data     string `json:"data,omitempty"`
+	DataHash string `json:"data_hash,omitempty"`
+}
+
+// auditSink is where audit events are written
+type auditSink interface {
+	write(ctx context.Context, event AuditEvent) error
+	close() error
+}
+
+// setupAudit opens the configured audit sink for a Tarka instance
+func (p *Provider) setupAudit(baseURL string) error {
+	var sink auditSink
+	switch p.Audit.Sink {
+	case "", AuditSinkFile:
+		if p.Audit.Path == "" {
+			return fmt.Errorf("the audit file sink needs a path")
+		}
+		f, err := os.OpenFile(p.Audit.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		sink = &fileAuditSink{file: f}
+	case AuditSinkLog:
+		sink = &logAuditSink{log: caddy.Log().Named("dns.providers.tarka.audit")}
+	case AuditSinkStorage:
+		if p.storage == nil {
+			return fmt.Errorf("the audit storage sink needs Caddy's storage")
+		}
+		sink = &storageAuditSink{storage: p.storage, prefix: storagePrefix("audit", baseURL)}
+	default:
+		return fmt.Errorf("invalid audit sink %q: must be %s, %s or %s", p.Audit.Sink, AuditSinkFile, AuditSinkLog, AuditSinkStorage)
+	}
+
+	if id, err := caddy.InstanceID(); err == nil {
+		p.instanceID = id.String()
+	} else {
+		p.log.Warn("audit events will have no instance ID", zap.Error(err))
+	}
+	p.auditSink = sink
+	return nil
+}
+
+// audit records a change sent to Tarka: an add if before is nil, a delete if
+// after is nil and an edit otherwise. A sink that fails is logged, as the
+// change has been made by then.
+func (p *Provider) audit(ctx context.Context, zone, domainID string, before, after *client.Record, err error) {
+	if p.auditSink == nil {
+		return
+	}
+	if normalized, err := normalizeZone(zone); err == nil {
+		zone = normalized
+	}
+	event := AuditEvent{
+		Time:       time.Now().UTC(),
+		InstanceID: p.instanceID,
+		Zone:       zone,
+		DomainID:   domainID,
+		Before:     auditRecord(before, zone),
+		After:      auditRecord(after, zone),
+		Outcome:    auditSuccess,
+	}
+	switch {
+	case before == nil:
+		event.Operation = "add"
+		event.Subject = challengeCertificate(after.Name, zone)
+	case after == nil:
+		event.Operation = "delete"
+		event.Subject = challengeCertificate(before.Name, zone)
+	default:
+		event.Operation = "edit"
+		event.Subject = challengeCertificate(after.Name, zone)
+	}
+	if err != nil {
+		event.Outcome, event.Error = auditFailure, err.Error()
+	} else if p.DryRun {
+		event.Outcome = auditDryRun
+	}
+
+	if err := p.auditSink.write(ctx, event); err != nil {
+		p.log.Error("failed to write audit event", zap.String("operation", event.Operation),
+			zap.String("zone", zone), zap.String("outcome", event.Outcome), zap.Error(err))
+	}
+}
+
+// added returns the record an add created, or the one it tried to add if it
+// failed, for auditing
+func added(created, attempted client.Record, err error) *client.Record {
+	if err != nil {
+		return &attempted
+	}
+	return &created
+}
+
+func auditRecord(rec *client.Record, zone string) *AuditRecord {
+	if rec == nil {
+		return nil
+	}
+	audited := &AuditRecord{ID: rec.ID, Name: rec.Name, Type: rec.Type, TTL: rec.TTL}
+	switch {
+	case rec.Data == "":
+	case isChallengeData(*rec, zone):
+		audited.DataHash = dataHash(rec.Data)
+	default:
+		audited.Data = rec.Data
+	}
+	return audited
+}
+
+// isChallengeData reports whether a record's data is an ACME challenge
+// token. Delegated challenge records are named after their delegation
+// target, so besides the name, the expiry every challenge record gets marks
+// them.
+func isChallengeData(rec client.Record, zone string) bool {
+	return rec.Type == "TXT" && (challengeCertificate(rec.Name, zone) != "" || !rec.Expires.IsZero())
+}
+
+// fileAuditSink appends events to a file, one JSON object per line
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *fileAuditSink) write(_ context.Context, event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// One write per line, so lines from instances sharing the file don't interleave
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *fileAuditSink) close() error {
+	return s.file.Close()
+}
+
+// logAuditSink writes events to a logger, which Caddy's logging config can
+// send anywhere
+type logAuditSink struct {
+	log *zap.Logger
+}
+
+func (s *logAuditSink) write(_ context.Context, event AuditEvent) error {
+	s.log.Info("record change",
+		zap.Time("time", event.Time),
+		zap.String("instance_id", event.InstanceID),
+		zap.String("operation", event.Operation),
+		zap.String("zone", event.Zone),
+		zap.String("domain_id", event.DomainID),
+		zap.Any("before", event.Before),
+		zap.Any("after", event.After),
+		zap.String("subject", event.Subject),
+		zap.String("outcome", event.Outcome),
+		zap.String("error", event.Error))
+	return nil
+}
+
+func (s *logAuditSink) close() error {
+	return nil
+}
+
+// storageAuditSink writes each event as a JSON line to its own key, under
+// prefix/<date>/<time>-<random>.json, so events are never overwritten and
+// list in the order they were made
+type storageAuditSink struct {
+	storage certmagic.Storage
+	prefix  string
+}
+
+func (s *storageAuditSink) write(ctx context.Context, event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := path.Join(s.prefix, event.Time.Format("2006-01-02"),
+		event.Time.Format("150405.000000000")+"-"+hex.EncodeToString(suffix)+".json")
+	return s.storage.Store(ctx, key, append(line, '\n'))
+}
+
+func (s *storageAuditSink) close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+package tarka
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestAudit_File(t *testing.T) {
+	// caddy.InstanceID keeps the ID in the app data dir
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	p := newTestProvider(server.URL)
+	p.Audit = &AuditConfig{Path: file}
+	if err := p.setupAudit(server.BaseURL()); err != nil {
+		t.Fatalf("setupAudit failed: %v", err)
+	}
+	ctx := context.Background()
+
+	challenge := libdns.TXT{Name: "_acme-challenge.www", Text: "token"}
+	if _, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{challenge}); err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if _, err := p.SetRecords(ctx, "example.com.", []libdns.Record{
+		libdns.RR{Name: "www", Type: "A", TTL: 5 * time.Minute, Data: "192.0.2.2"},
+	}); err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+	if _, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{challenge}); err != nil {
+		t.Fatalf("DeleteRecords failed: %v", err)
+	}
+	if err := p.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "token") {
+		t.Error("expected the challenge token to be left out of the audit log")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []AuditEvent
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+
+	add, edit, del := events[0], events[1], events[2]
+	if add.Operation != "add" || add.Before != nil || add.After == nil || add.After.ID == "" || add.After.DataHash != dataHash("token") || add.Subject != "www.example.com" {
+		t.Errorf("unexpected add event %+v", add)
+	}
+	if edit.Operation != "edit" || edit.Before.Data != "192.0.2.1" || edit.After.Data != "192.0.2.2" || edit.After.DataHash != "" || edit.Subject != "" {
+		t.Errorf("unexpected edit event %+v", edit)
+	}
+	if del.Operation != "delete" || del.After != nil || del.Before.ID != add.After.ID {
+		t.Errorf("unexpected delete event %+v", del)
+	}
+	for _, event := range events {
+		if event.Zone != "example.com" || event.DomainID != "123" || event.Outcome != auditSuccess || event.InstanceID == "" || event.Time.IsZero() {
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+}
+
+func TestAudit_Storage(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	p := newTestProvider(server.URL)
+	p.DryRun = true
+	p.storage = storage
+	p.Audit = &AuditConfig{Sink: AuditSinkStorage}
+	if err := p.setupAudit(server.BaseURL()); err != nil {
+		t.Fatalf("setupAudit failed: %v", err)
+	}
+	ctx := context.Background()
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := p.AppendRecords(ctx, "example.com", []libdns.Record{libdns.TXT{Name: name, Text: "x"}}); err != nil {
+			t.Fatalf("AppendRecords failed: %v", err)
+		}
+	}
+	listed, err := storage.List(ctx, storagePrefix("audit", server.BaseURL()), true)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var keys []string
+	for _, key := range listed {
+		if strings.HasSuffix(key, ".json") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 {
+		t.Fatalf("expected an event per change, got %v", keys)
+	}
+	data, err := storage.Load(ctx, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event AuditEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("invalid event %q: %v", data, err)
+	}
+	if event.Operation != "add" || event.Outcome != auditDryRun {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	p.storage = nil
+	if err := p.setupAudit(server.BaseURL()); err == nil {
+		t.Error("expected an error for the storage sink without storage")
+	}
+}
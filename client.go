@@ -3,16 +3,12 @@ package tarka
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/libdns/libdns"
-	"go.uber.org/zap"
+	"github.com/nsna/tarka/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // createRecord is a helper function to create a libdns.Record from an RR
@@ -25,196 +21,275 @@ func createRecord(name, recordType, data string, ttl time.Duration) libdns.Recor
 	}
 }
 
-// ensureAuthenticated makes sure we have a valid session
-func (p *Provider) ensureAuthenticated(ctx context.Context) error {
-	if p.httpClient != nil && p.isSessionValid(ctx) {
-		return nil
+// getClient returns the Tarka client, creating it from the provider config on first use
+func (p *Provider) getClient() (*client.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client == nil {
+		c, err := client.New(client.Config{
+			BaseURL:              p.BaseURL,
+			Username:             p.Username,
+			Password:             p.Password,
+			Transport:            p.Transport,
+			SessionCheckInterval: p.SessionCheckInterval,
+			Logger:               p.log,
+			Observer:             p.metrics,
+			TracerProvider:       p.tracerProvider,
+			DryRun:               p.DryRun,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.client = c
 	}
-	p.log.Info("session is invalid or uninitialized, authenticating")
-	return p.login(ctx)
+	return p.client, nil
 }
 
-// isSessionValid checks if the current session is still valid
-func (p *Provider) isSessionValid(ctx context.Context) bool {
-	if p.httpClient == nil {
-		return false
+// zoneClient returns the Tarka client along with the domain ID for zone
+func (p *Provider) zoneClient(ctx context.Context, zone string) (*client.Client, string, error) {
+	c, err := p.getClient()
+	if err != nil {
+		return nil, "", err
 	}
-
-	baseURL := p.BaseURL
-	if baseURL == "" {
-		baseURL = "https://tarka.cloud/custdata"
+	domainID, err := p.resolveDomainID(ctx, c, zone)
+	if err != nil {
+		return nil, "", err
 	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("tarka.domain_id", domainID))
+	return c, domainID, nil
+}
 
-	u, err := url.Parse(baseURL)
+// listRecords lists the records of a domain with their names normalized to
+// the form tarkaName produces and default TTLs filled in, so they compare
+// equal to converted input records
+func (p *Provider) listRecords(ctx context.Context, c *client.Client, zone, domainID string) ([]client.Record, error) {
+	listed, err := c.ListRecords(ctx, domainID)
 	if err != nil {
-		p.log.Error("failed to parse BaseURL for session validation", zap.String("base_url", baseURL), zap.Error(err))
-		return false
+		return nil, err
 	}
-	if len(p.httpClient.Jar.Cookies(u)) == 0 {
-		return false
+	for i, rec := range listed {
+		if name, err := tarkaName(rec.Name, zone); err == nil {
+			listed[i].Name = name
+		}
+		// A blank TTL in the listing means Tarka's default
+		if rec.TTL == 0 {
+			listed[i].TTL = client.DefaultTTL
+		}
 	}
+	return listed, nil
+}
 
-	// Create a GET request to the customer view page
-	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/customer-view.php", nil)
-	if err != nil {
-		// If we can't create the request, assume session is invalid
-		p.log.Error("failed to create session validation request", zap.Error(err))
-		return false
+// resolveDomainID returns the Tarka domain ID for zone: the configured
+// DomainID if zone is its domain, otherwise the ID of the account's domain
+// with that name.
+func (p *Provider) resolveDomainID(ctx context.Context, c *client.Client, zone string) (string, error) {
+	if p.DomainID == "" {
+		return p.lookupDomainID(ctx, c, zone)
 	}
-
-	// Configure client to not follow redirects so we can detect them
-	client := &http.Client{
-		Jar:     p.httpClient.Jar, // Use the same cookie jar
-		Timeout: 10 * time.Second, // Shorter timeout for validation
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// Don't follow redirects - we want to detect them
-			return http.ErrUseLastResponse
-		},
+	name, err := normalizeZone(zone)
+	if err != nil {
+		return "", err
 	}
-
-	// Execute the request
-	resp, err := client.Do(req)
+	domainZone, err := p.configuredZone(ctx, c)
 	if err != nil {
-		// Network error or timeout, assume session is invalid
-		p.log.Error("session validation request failed", zap.Error(err))
-		return false
+		return "", err
 	}
-	defer resp.Body.Close()
-
-	// Check if we got a successful response
-	if resp.StatusCode == http.StatusOK {
-		p.log.Info("session validation successful")
-		return true
+	if name == domainZone {
+		return p.DomainID, nil
 	}
-
-	// If we got a redirect (3xx) or any other non-200 status,
-	// the session is likely invalid
-	p.log.Warn("session validation failed", zap.Int("status_code", resp.StatusCode))
-	return false
+	return p.lookupDomainID(ctx, c, zone)
 }
 
-// login performs the form-based authentication
-func (p *Provider) login(ctx context.Context) error {
-	if p.httpClient == nil {
-		jar, err := cookiejar.New(nil)
-		if err != nil {
-			return fmt.Errorf("failed to create cookie jar: %w", err)
-		}
-		p.httpClient = &http.Client{
-			Jar:     jar,
-			Timeout: 30 * time.Second,
-		}
-	}
-
-	baseURL := p.BaseURL
-	if baseURL == "" {
-		baseURL = "https://tarka.cloud/custdata"
+// configuredZone returns the zone name of the configured DomainID, looking
+// it up once
+func (p *Provider) configuredZone(ctx context.Context, c *client.Client) (string, error) {
+	p.mu.Lock()
+	zone := p.domainZone
+	p.mu.Unlock()
+	if zone != "" {
+		return zone, nil
 	}
 
-	// Prepare login data
-	loginData := url.Values{}
-	loginData.Set("do_login", "1")
-	loginData.Set("username", p.Username)
-	loginData.Set("password", p.Password)
-
-	// Create login request
-	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/login.php", strings.NewReader(loginData.Encode()))
+	domains, err := c.ListDomains(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create login request: %w", err)
+		return "", err
 	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// Execute login request
-	resp, err := p.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("login request failed: %w", err)
+	for _, domain := range domains {
+		if domain.ID != p.DomainID {
+			continue
+		}
+		if zone, err = normalizeZone(domain.Name); err != nil {
+			return "", err
+		}
+		p.mu.Lock()
+		p.domainZone = zone
+		p.mu.Unlock()
+		return zone, nil
 	}
-	defer resp.Body.Close()
+	return "", fmt.Errorf("domain_id %s not found in Tarka account", p.DomainID)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("login failed with status: %d", resp.StatusCode)
+// lookupDomainID returns the ID of the account's domain named zone
+func (p *Provider) lookupDomainID(ctx context.Context, c *client.Client, zone string) (string, error) {
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return "", err
 	}
-
-	// Check that the auth cookie was set in the jar
-	u, err := url.Parse(baseURL)
+	name, err := normalizeZone(zone)
 	if err != nil {
-		return fmt.Errorf("failed to parse base URL: %w", err)
+		return "", err
 	}
-	for _, cookie := range p.httpClient.Jar.Cookies(u) {
-		if cookie.Name == "tarka_netcraft_com_au-auth-cookie-2" {
-			p.log.Info("successfully authenticated and obtained session cookie")
-			return nil
+	for _, domain := range domains {
+		if domainName, err := normalizeZone(domain.Name); err == nil && domainName == name {
+			return domain.ID, nil
 		}
 	}
-
-	return fmt.Errorf("no auth cookie received after login")
+	return "", fmt.Errorf("zone %s not found in Tarka account", zone)
 }
 
-// addTXTRecord adds a TXT record using the Tarka DNS API
-func (p *Provider) addTXTRecord(ctx context.Context, name, data string, ttl time.Duration) error {
-	baseURL := p.BaseURL
-	if baseURL == "" {
-		baseURL = "https://tarka.cloud/custdata"
-	}
+// ProviderData is attached to the records the provider returns, identifying
+// the exact Tarka row behind each record. Passing a record carrying it back to
+// DeleteRecords or SetRecords targets that row rather than matching by value.
+type ProviderData struct {
+	// ID is Tarka's record ID (rr_id)
+	ID string `json:"id"`
 
-	domainID := p.DomainID
-	if domainID == "" {
-		domainID = "77" // Default domain ID
-	}
+	// DomainID is the Tarka domain the record belongs to
+	DomainID string `json:"domain_id"`
 
-	// The name comes from libdns as a relative name (e.g., "_acme-challenge.app.tic")
-	// We need to process it for Tarka's API which expects the name without the zone suffix
-	recordName := name
+	// Expires is when Tarka will remove the record, with the zero time meaning never
+	Expires time.Time `json:"expires,omitzero"`
 
-	// Handle root zone records
-	if recordName == "@" {
-		recordName = ""
-	}
+	// DryRun marks a record the provider only pretended to change
+	DryRun bool `json:"dry_run,omitempty"`
+}
 
-	// Convert TTL to seconds, default to empty string if not specified
-	ttlStr := ""
-	if ttl > 0 {
-		ttlStr = strconv.Itoa(int(ttl.Seconds()))
+// providerDataOf returns the ProviderData carried by a record, if any
+func providerDataOf(record libdns.Record) (ProviderData, bool) {
+	var data any
+	switch r := record.(type) {
+	case libdns.Address:
+		data = r.ProviderData
+	case libdns.CAA:
+		data = r.ProviderData
+	case libdns.CNAME:
+		data = r.ProviderData
+	case libdns.MX:
+		data = r.ProviderData
+	case libdns.NS:
+		data = r.ProviderData
+	case libdns.SRV:
+		data = r.ProviderData
+	case libdns.ServiceBinding:
+		data = r.ProviderData
+	case libdns.TXT:
+		data = r.ProviderData
 	}
+	switch pd := data.(type) {
+	case ProviderData:
+		return pd, true
+	case *ProviderData:
+		if pd != nil {
+			return *pd, true
+		}
+	}
+	return ProviderData{}, false
+}
 
-	// Prepare record data
-	recordData := url.Values{}
-	recordData.Set("domain_id", domainID)
-	recordData.Set("do_change", "1")
-	recordData.Set("do_add", "1")
-	recordData.Set("name", recordName)
-	recordData.Set("ttl", ttlStr)
-	recordData.Set("rr_type_id", "8") // TXT record type
-	recordData.Set("data", data)
-	recordData.Set("caa_flags", "0")
-	recordData.Set("caa_tag", "issue")
-	recordData.Set("caa_value", "")
-	recordData.Set("expires", "10 minutes") // Auto-expire for ACME challenges
-
-	p.log.Info("Adding TXT record", zap.Any("record", recordData))
+// withProviderData returns record with its ProviderData set, where the record
+// type has the field
+func withProviderData(record libdns.Record, data ProviderData) libdns.Record {
+	switch r := record.(type) {
+	case libdns.Address:
+		r.ProviderData = data
+		return r
+	case libdns.CAA:
+		r.ProviderData = data
+		return r
+	case libdns.CNAME:
+		r.ProviderData = data
+		return r
+	case libdns.MX:
+		r.ProviderData = data
+		return r
+	case libdns.NS:
+		r.ProviderData = data
+		return r
+	case libdns.SRV:
+		r.ProviderData = data
+		return r
+	case libdns.ServiceBinding:
+		r.ProviderData = data
+		return r
+	case libdns.TXT:
+		r.ProviderData = data
+		return r
+	}
+	return record
+}
 
-	// Create the request
-	requestURL := fmt.Sprintf("%s/domain-rr-edit.php?domain_id=%s&do_add=1", baseURL, domainID)
-	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, strings.NewReader(recordData.Encode()))
-	if err != nil {
-		return fmt.Errorf("failed to create record request: %w", err)
+// changedRecord converts a record the provider added, updated or deleted for
+// returning to the caller, marking it if the change was only a dry run
+func (p *Provider) changedRecord(rec client.Record, zone, domainID string) libdns.Record {
+	record := fromTarkaRecord(rec, zone, domainID)
+	if p.DryRun {
+		if data, ok := providerDataOf(record); ok {
+			data.DryRun = true
+			record = withProviderData(record, data)
+		}
 	}
+	return record
+}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// toTarkaRecord converts a libdns record to the form Tarka takes. The Tarka
+// record ID is carried over when the record has ProviderData for domainID.
+func toTarkaRecord(record libdns.Record, zone, domainID string) (client.Record, error) {
+	rr := record.RR()
 
-	// Execute the request
-	resp, err := p.httpClient.Do(req)
+	recordName, err := tarkaName(rr.Name, zone)
 	if err != nil {
-		return fmt.Errorf("record creation request failed: %w", err)
+		return client.Record{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		// Read response body for debugging
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("record creation failed with status %d: %s", resp.StatusCode, string(body))
+	rec := client.Record{
+		Name: recordName,
+		Type: rr.Type,
+		TTL:  int(rr.TTL.Seconds()),
+		Data: rr.Data,
+	}
+	switch rec.Type {
+	case "TXT":
+		// Long or quoted text has to be split into character strings for Tarka
+		rec.Data = client.EncodeTXT(rr.Data)
+	case "CNAME", "NS", "PTR", "MX", "SRV":
+		rec.Data = hostData(rr.Data)
 	}
+	if data, ok := providerDataOf(record); ok && data.DomainID == domainID {
+		rec.ID = data.ID
+	}
+	return rec, nil
+}
 
-	return nil
+// fromTarkaRecord converts a record from a Tarka listing to a libdns record,
+// using the type-specific struct where libdns has one
+func fromTarkaRecord(rec client.Record, zone, domainID string) libdns.Record {
+	name := libdnsName(rec.Name, zone)
+	data := rec.Data
+	if rec.Type == "TXT" {
+		if text, err := client.DecodeTXT(data); err == nil {
+			data = text
+		}
+	}
+	rr := createRecord(name, rec.Type, data, time.Duration(rec.TTL)*time.Second).RR()
+	parsed, err := rr.Parse()
+	if err != nil {
+		// Fall back to the opaque RR for data libdns cannot parse
+		return rr
+	}
+	return withProviderData(parsed, ProviderData{
+		ID:       rec.ID,
+		DomainID: domainID,
+		Expires:  rec.Expires,
+	})
 }
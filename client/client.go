@@ -0,0 +1,429 @@
+// Package client is a low-level client for Tarka DNS. Tarka has no API, so
+// the client drives the customer web UI the same way a browser would:
+// logging in with a form, scraping the domain and record listings, and
+// posting the record edit forms.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+)
+
+// DefaultBaseURL is the customer area of the hosted Tarka service
+const DefaultBaseURL = "https://tarka.cloud/custdata"
+
+// DefaultSessionCheckInterval is how long a validated session is trusted
+// before it is checked against Tarka again.
+const DefaultSessionCheckInterval = 5 * time.Minute
+
+// sessionCheckTimeout bounds the session validation request
+const sessionCheckTimeout = 10 * time.Second
+
+// tracerName identifies the client's spans
+const tracerName = "github.com/nsna/tarka/client"
+
+// authCookieName is the session cookie set by Tarka after a successful login
+const authCookieName = "tarka_netcraft_com_au-auth-cookie-2"
+
+// errSessionExpired is returned when Tarka answers a request as if we were
+// not logged in, so the caller can re-authenticate and try again
+var errSessionExpired = errors.New("session expired")
+
+// Config holds the settings for a Client
+type Config struct {
+	// BaseURL is the base URL for Tarka DNS (defaults to DefaultBaseURL)
+	BaseURL string
+
+	// Username and Password for the Tarka customer login
+	Username string
+	Password string
+
+	// Transport customises the HTTP client (optional)
+	Transport *TransportConfig
+
+	// How long a validated session is trusted before checking it again
+	// (defaults to DefaultSessionCheckInterval)
+	SessionCheckInterval time.Duration
+
+	// Logger for session events (defaults to a no-op logger)
+	Logger *zap.Logger
+
+	// Observer is notified of logins, session checks and requests (optional)
+	Observer Observer
+
+	// TracerProvider, if set, is used to trace each HTTP request to Tarka
+	TracerProvider trace.TracerProvider
+
+	// DryRun makes the client log record changes instead of submitting
+	// them. Logins and listings still go to Tarka.
+	DryRun bool
+}
+
+// Client talks to the Tarka web UI. It keeps a logged-in session and is safe
+// for concurrent use.
+type Client struct {
+	baseURL              string
+	username             string
+	password             string
+	sessionCheckInterval time.Duration
+	httpClient           *http.Client
+	jar                  *sessionJar
+	log                  *zap.Logger
+	observer             Observer
+	tracer               trace.Tracer
+	dryRun               bool
+
+	// mu guards the session state below
+	mu sync.Mutex
+
+	// When the session was last confirmed as valid by a login or check
+	sessionValidatedAt time.Time
+}
+
+// New returns a Client for the given config. It does not log in until the
+// first request is made.
+func New(cfg Config) (*Client, error) {
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+
+	httpClient, err := newHTTPClient(cfg.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP client: %w", err)
+	}
+
+	interval := cfg.SessionCheckInterval
+	if interval == 0 {
+		interval = DefaultSessionCheckInterval
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	observer := cfg.Observer
+	if observer == nil {
+		observer = nopObserver{}
+	}
+	tracerProvider := cfg.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = noop.NewTracerProvider()
+	}
+
+	return &Client{
+		baseURL:              baseURL,
+		username:             cfg.Username,
+		password:             cfg.Password,
+		sessionCheckInterval: interval,
+		httpClient:           httpClient,
+		jar:                  httpClient.Jar.(*sessionJar),
+		log:                  logger,
+		observer:             observer,
+		tracer:               tracerProvider.Tracer(tracerName),
+		dryRun:               cfg.DryRun,
+	}, nil
+}
+
+// BaseURL returns the base URL the client sends requests to
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// Login performs the form-based authentication, replacing any current session
+func (c *Client) Login(ctx context.Context) error {
+	err := c.login(ctx)
+	c.observer.LoggedIn(err)
+	return err
+}
+
+func (c *Client) login(ctx context.Context) error {
+	// Prepare login data
+	loginData := url.Values{}
+	loginData.Set("do_login", "1")
+	loginData.Set("username", c.username)
+	loginData.Set("password", c.password)
+
+	// Create login request
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/login.php", strings.NewReader(loginData.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create login request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Execute login request
+	resp, err := c.send(req)
+	if err != nil {
+		return fmt.Errorf("login request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login failed with status: %d", resp.StatusCode)
+	}
+
+	// Check that the auth cookie was set in the jar
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse base URL: %w", err)
+	}
+	for _, cookie := range c.jar.Cookies(u) {
+		if cookie.Name == authCookieName {
+			c.log.Info("successfully authenticated and obtained session cookie")
+			c.markSessionValidated()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no auth cookie received after login")
+}
+
+// withSession runs fn with an authenticated session. If fn reports that the
+// session expired, we log in again and retry fn once.
+func (c *Client) withSession(ctx context.Context, fn func() error) error {
+	if err := c.ensureAuthenticated(ctx); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+
+	err := fn()
+	if !errors.Is(err, errSessionExpired) {
+		return err
+	}
+
+	c.log.Info("session expired mid-request, re-authenticating and retrying")
+	c.invalidateSession()
+	if err := c.Login(ctx); err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
+	}
+	return fn()
+}
+
+// ensureAuthenticated makes sure we have a valid session
+func (c *Client) ensureAuthenticated(ctx context.Context) error {
+	if c.sessionRecentlyValidated() {
+		return nil
+	}
+	if c.isSessionValid(ctx) {
+		c.markSessionValidated()
+		return nil
+	}
+	c.log.Info("session is invalid or uninitialized, authenticating")
+	return c.Login(ctx)
+}
+
+// sessionRecentlyValidated reports whether the session was validated within
+// the check interval and its cookie has not expired, so we can skip the round trip.
+func (c *Client) sessionRecentlyValidated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sessionValidatedAt.IsZero() {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(c.sessionValidatedAt) >= c.sessionCheckInterval {
+		return false
+	}
+	if expires := c.jar.cookieExpiry(); !expires.IsZero() && !now.Before(expires) {
+		return false
+	}
+	return true
+}
+
+// markSessionValidated records that the session was just confirmed as valid
+func (c *Client) markSessionValidated() {
+	c.mu.Lock()
+	c.sessionValidatedAt = time.Now()
+	c.mu.Unlock()
+}
+
+// invalidateSession forgets when the session was last validated, forcing a check
+func (c *Client) invalidateSession() {
+	c.mu.Lock()
+	c.sessionValidatedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+// isSessionValid checks if the current session is still valid
+func (c *Client) isSessionValid(ctx context.Context) bool {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		c.log.Error("failed to parse BaseURL for session validation", zap.String("base_url", c.baseURL), zap.Error(err))
+		return false
+	}
+	if len(c.jar.Cookies(u)) == 0 {
+		return false
+	}
+
+	// Use a shorter timeout for validation than for other requests
+	ctx, cancel := context.WithTimeout(ctx, sessionCheckTimeout)
+	defer cancel()
+
+	// Create a GET request to the customer view page
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/customer-view.php", nil)
+	if err != nil {
+		// If we can't create the request, assume session is invalid
+		c.log.Error("failed to create session validation request", zap.Error(err))
+		return false
+	}
+
+	// Execute the request
+	resp, err := c.send(req)
+	if err != nil {
+		// Network error or timeout, assume session is invalid
+		c.log.Error("session validation request failed", zap.Error(err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	// An expired session is bounced to the login page, so check where we ended up
+	valid := resp.StatusCode == http.StatusOK && !isSessionExpired(resp)
+	c.observer.SessionChecked(valid)
+	if valid {
+		c.log.Info("session validation successful")
+		return true
+	}
+
+	c.log.Warn("session validation failed", zap.Int("status_code", resp.StatusCode), zap.String("url", resp.Request.URL.Path))
+	return false
+}
+
+// get fetches a page of the web UI, returning its body
+func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	requestURL := c.baseURL + "/" + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return c.do(req)
+}
+
+// postForm submits a web UI form, returning the body of the resulting page
+func (c *Client) postForm(ctx context.Context, path string, query, form url.Values) ([]byte, error) {
+	requestURL := c.baseURL + "/" + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// do executes req, mapping a bounce to the login page to errSessionExpired
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if isSessionExpired(resp) {
+		return nil, errSessionExpired
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// send executes req in a span of its own, reporting it to the observer.
+// Only the method and page are recorded, never form values or cookies.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	endpoint := path.Base(req.URL.Path)
+	ctx, span := c.tracer.Start(req.Context(), req.Method+" "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("tarka.endpoint", endpoint),
+		))
+	defer span.End()
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	reported := err
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		reported = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	c.observer.RequestDone(endpoint, time.Since(start), reported)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "request failed")
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	return resp, nil
+}
+
+// isSessionExpired reports whether a response indicates our session is no longer
+// accepted: either an auth error, or we ended up on the login page.
+func isSessionExpired(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return true
+	}
+	return resp.Request != nil && strings.HasSuffix(resp.Request.URL.Path, "/login.php")
+}
+
+// sessionJar wraps a cookie jar to remember when the auth cookie expires,
+// since http.CookieJar does not report expiry back to us
+type sessionJar struct {
+	http.CookieJar
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.CookieJar.SetCookies(u, cookies)
+	for _, cookie := range cookies {
+		if cookie.Name != authCookieName {
+			continue
+		}
+		j.mu.Lock()
+		switch {
+		case cookie.MaxAge < 0:
+			j.expires = time.Unix(1, 0)
+		case cookie.MaxAge > 0:
+			j.expires = time.Now().Add(time.Duration(cookie.MaxAge) * time.Second)
+		default:
+			// A zero Expires means a browser-session cookie with no set expiry
+			j.expires = cookie.Expires
+		}
+		j.mu.Unlock()
+	}
+}
+
+// cookieExpiry returns when the auth cookie expires, or the zero time if unknown
+func (j *sessionJar) cookieExpiry() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.expires
+}
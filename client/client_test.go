@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func newTestClient(t *testing.T, server *tarkatest.Server) *Client {
+	t.Helper()
+	c, err := New(Config{
+		BaseURL:  server.BaseURL(),
+		Username: tarkatest.Username,
+		Password: tarkatest.Password,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return c
+}
+
+func TestClient_isSessionValid(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+
+	// Test case 1: Valid session
+	t.Run("valid session", func(t *testing.T) {
+		c := newTestClient(t, server)
+		if err := c.Login(context.Background()); err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		if !c.isSessionValid(context.Background()) {
+			t.Error("expected session to be valid, but it was invalid")
+		}
+	})
+
+	// Test case 2: Invalid session (bad cookie)
+	t.Run("invalid session with bad cookie", func(t *testing.T) {
+		c := newTestClient(t, server)
+		u, _ := url.Parse(c.BaseURL())
+		c.jar.SetCookies(u, []*http.Cookie{{Name: authCookieName, Value: "invalid-cookie"}})
+
+		if c.isSessionValid(context.Background()) {
+			t.Error("expected session to be invalid with a bad cookie, but it was valid")
+		}
+	})
+
+	// Test case 3: No session (never logged in)
+	t.Run("no session", func(t *testing.T) {
+		c := newTestClient(t, server)
+		if c.isSessionValid(context.Background()) {
+			t.Error("expected session to be invalid before logging in, but it was valid")
+		}
+	})
+}
+
+func TestClient_Login_BadCredentials(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+
+	c, err := New(Config{BaseURL: server.BaseURL(), Username: "testuser", Password: "wrongpass"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	err = c.Login(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "login failed") {
+		t.Errorf("expected login failure, got: %v", err)
+	}
+}
+
+func TestClient_RetriesAfterSessionExpiry(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("77", "example.com")
+
+	c := newTestClient(t, server)
+	if _, err := c.ListRecords(context.Background(), "77"); err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+
+	// The client still trusts its session, so the listing request is bounced
+	// to the login page and must be retried after logging in again
+	server.ExpireSessions()
+	if _, err := c.ListRecords(context.Background(), "77"); err != nil {
+		t.Fatalf("ListRecords after expiry failed: %v", err)
+	}
+	if got := server.Requests("/custdata/domain-view.php"); got != 3 {
+		t.Errorf("expected 3 listing requests, got %d", got)
+	}
+}
+
+func TestClient_ReusesValidatedSession(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("77", "example.com")
+
+	c := newTestClient(t, server)
+	for i := 0; i < 3; i++ {
+		if _, err := c.ListRecords(context.Background(), "77"); err != nil {
+			t.Fatalf("ListRecords call %d failed: %v", i, err)
+		}
+	}
+	if got := server.Requests("/custdata/login.php"); got != 1 {
+		t.Errorf("expected 1 login, got %d", got)
+	}
+	// Logging in lands on the customer view, but no separate checks are made
+	if got := server.Requests("/custdata/customer-view.php"); got != 1 {
+		t.Errorf("expected no session checks within the interval, got %d", got-1)
+	}
+
+	// Once the interval has passed the session is checked again rather than trusted
+	c.sessionCheckInterval = time.Nanosecond
+	if _, err := c.ListRecords(context.Background(), "77"); err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if got := server.Requests("/custdata/customer-view.php"); got != 2 {
+		t.Errorf("expected 1 session check after the interval, got %d", got-1)
+	}
+	if got := server.Requests("/custdata/login.php"); got != 1 {
+		t.Errorf("expected the still-valid session to be reused, got %d logins", got)
+	}
+}
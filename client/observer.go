@@ -0,0 +1,25 @@
+package client
+
+import "time"
+
+// Observer is notified of client events, e.g. to record metrics. Its methods
+// are called synchronously and must be safe for concurrent use.
+type Observer interface {
+	// LoggedIn is called after each login attempt, with its error if it failed
+	LoggedIn(err error)
+
+	// SessionChecked is called after the session is checked against Tarka
+	SessionChecked(valid bool)
+
+	// RequestDone is called after each HTTP request to Tarka, with the page
+	// requested (e.g. domain-view.php) and the error if the request failed
+	// or Tarka answered with an error status
+	RequestDone(endpoint string, duration time.Duration, err error)
+}
+
+// nopObserver is used when no Observer is configured
+type nopObserver struct{}
+
+func (nopObserver) LoggedIn(error)                           {}
+func (nopObserver) SessionChecked(bool)                      {}
+func (nopObserver) RequestDone(string, time.Duration, error) {}
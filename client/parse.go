@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// expiresLayout is how the record listing shows expiry times
+const expiresLayout = "2006-01-02 15:04:05"
+
+// parseDomains extracts the domains linked from the customer view page.
+// Each domain links to domain-view.php?domain_id=N with the zone name as text.
+func parseDomains(body []byte) ([]Domain, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse domain listing: %w", err)
+	}
+
+	var domains []Domain
+	seen := make(map[string]bool)
+	for n := range doc.Descendants() {
+		if n.Type != html.ElementNode || n.DataAtom != atom.A {
+			continue
+		}
+		href, err := url.Parse(attr(n, "href"))
+		if err != nil || !strings.HasSuffix(href.Path, "domain-view.php") {
+			continue
+		}
+		id := href.Query().Get("domain_id")
+		name := strings.TrimSuffix(strings.ToLower(text(n)), ".")
+		if id == "" || name == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		domains = append(domains, Domain{ID: id, Name: name})
+	}
+	return domains, nil
+}
+
+// parseRecords extracts the records from a domain's record listing. The
+// listing is a table with a header row naming its columns; the record ID is
+// taken from the row's edit link.
+func parseRecords(body []byte) ([]Record, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse record listing: %w", err)
+	}
+
+	for table := range doc.Descendants() {
+		if table.Type != html.ElementNode || table.DataAtom != atom.Table {
+			continue
+		}
+		records, ok, err := parseRecordTable(table)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return records, nil
+		}
+	}
+	return nil, fmt.Errorf("no record table found in listing")
+}
+
+// parseRecordTable parses table as a record listing. It reports false if the
+// table does not have the columns of a record listing.
+func parseRecordTable(table *html.Node) ([]Record, bool, error) {
+	columns := make(map[string]int)
+	var records []Record
+	for row := range table.Descendants() {
+		if row.Type != html.ElementNode || row.DataAtom != atom.Tr {
+			continue
+		}
+
+		var cells []*html.Node
+		header := false
+		for cell := row.FirstChild; cell != nil; cell = cell.NextSibling {
+			if cell.Type != html.ElementNode {
+				continue
+			}
+			switch cell.DataAtom {
+			case atom.Th:
+				header = true
+				cells = append(cells, cell)
+			case atom.Td:
+				cells = append(cells, cell)
+			}
+		}
+
+		if header {
+			for i, cell := range cells {
+				columns[strings.ToLower(text(cell))] = i
+			}
+			for _, required := range []string{"name", "type", "data"} {
+				if _, ok := columns[required]; !ok {
+					return nil, false, nil
+				}
+			}
+			continue
+		}
+		if len(columns) == 0 {
+			continue
+		}
+
+		cell := func(column string) string {
+			i, ok := columns[column]
+			if !ok || i >= len(cells) {
+				return ""
+			}
+			return text(cells[i])
+		}
+
+		rec := Record{
+			ID:   rowRecordID(row),
+			Name: cell("name"),
+			Type: strings.ToUpper(cell("type")),
+			Data: cell("data"),
+		}
+		if rec.Name == "@" {
+			rec.Name = ""
+		}
+		if ttl := cell("ttl"); ttl != "" {
+			seconds, err := strconv.Atoi(ttl)
+			if err != nil {
+				return nil, true, fmt.Errorf("invalid TTL %q for record %s", ttl, rec.ID)
+			}
+			rec.TTL = seconds
+		}
+		if expires := cell("expires"); expires != "" && !strings.EqualFold(expires, "never") {
+			t, err := time.ParseInLocation(expiresLayout, expires, time.UTC)
+			if err != nil {
+				return nil, true, fmt.Errorf("invalid expiry %q for record %s", expires, rec.ID)
+			}
+			rec.Expires = t
+		}
+		records = append(records, rec)
+	}
+	if len(columns) == 0 {
+		return nil, false, nil
+	}
+	return records, true, nil
+}
+
+// rowRecordID finds the rr_id in any link within a listing row
+func rowRecordID(row *html.Node) string {
+	for n := range row.Descendants() {
+		if n.Type != html.ElementNode || n.DataAtom != atom.A {
+			continue
+		}
+		href, err := url.Parse(attr(n, "href"))
+		if err != nil {
+			continue
+		}
+		if id := href.Query().Get("rr_id"); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// attr returns the value of the named attribute of n
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// text returns the whitespace-trimmed text content of n
+func text(n *html.Node) string {
+	var sb strings.Builder
+	for d := range n.Descendants() {
+		if d.Type == html.TextNode {
+			sb.WriteString(d.Data)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
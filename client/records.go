@@ -0,0 +1,321 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TTL limits of the web UI's record form, in seconds. A blank TTL gets DefaultTTL.
+const (
+	MinTTL     = 60
+	MaxTTL     = 604800
+	DefaultTTL = 3600
+)
+
+// Domain is a zone in the Tarka account
+type Domain struct {
+	// ID is Tarka's numeric domain ID, as used in domain_id form fields
+	ID string
+
+	// Name is the zone name, e.g. example.com
+	Name string
+}
+
+// Record is a resource record as shown in Tarka's record listing
+type Record struct {
+	// ID is Tarka's record ID (rr_id), empty for records not yet created
+	ID string
+
+	// Name is relative to the domain, with "" for the domain apex
+	Name string
+
+	// Type is the record type, e.g. TXT
+	Type string
+
+	// TTL in seconds, with 0 meaning Tarka's default
+	TTL int
+
+	// Data is the record data in the form the web UI takes it
+	Data string
+
+	// Expires is when Tarka will remove the record, with the zero time
+	// meaning never
+	Expires time.Time
+}
+
+// recordTypeIDs maps record types to the values of the web UI's rr_type_id select
+var recordTypeIDs = map[string]string{
+	"A":     "1",
+	"AAAA":  "2",
+	"CNAME": "3",
+	"MX":    "4",
+	"NS":    "5",
+	"PTR":   "6",
+	"SRV":   "7",
+	"TXT":   "8",
+	"CAA":   "9",
+}
+
+// SupportedTypes returns the record types Tarka accepts, sorted
+func SupportedTypes() []string {
+	types := make([]string, 0, len(recordTypeIDs))
+	for recordType := range recordTypeIDs {
+		types = append(types, recordType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// IsSupportedType reports whether Tarka accepts records of the given type
+func IsSupportedType(recordType string) bool {
+	_, ok := recordTypeIDs[recordType]
+	return ok
+}
+
+// ListDomains returns the domains in the account, from the customer view page
+func (c *Client) ListDomains(ctx context.Context) ([]Domain, error) {
+	var domains []Domain
+	err := c.withSession(ctx, func() error {
+		body, err := c.get(ctx, "customer-view.php", nil)
+		if err != nil {
+			return err
+		}
+		domains, err = parseDomains(body)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	return domains, nil
+}
+
+// ListRecords returns the records of a domain, from its record listing page
+func (c *Client) ListRecords(ctx context.Context, domainID string) ([]Record, error) {
+	var records []Record
+	err := c.withSession(ctx, func() error {
+		body, err := c.get(ctx, "domain-view.php", url.Values{"domain_id": {domainID}})
+		if err != nil {
+			return err
+		}
+		records, err = parseRecords(body)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list records for domain %s: %w", domainID, err)
+	}
+	return records, nil
+}
+
+// AddRecord creates a record in a domain. The returned record carries the
+// ID Tarka assigned, found in the listing Tarka responds with or failing
+// that, in a fresh listing of the domain; if it can't be found the record is
+// still created, but an error is returned. In dry-run mode the record is
+// returned without an ID.
+func (c *Client) AddRecord(ctx context.Context, domainID string, rec Record) (Record, error) {
+	form, err := recordForm(domainID, rec)
+	if err != nil {
+		return Record{}, err
+	}
+	form.Set("do_add", "1")
+	query := url.Values{"domain_id": {domainID}, "do_add": {"1"}}
+
+	created := rec
+	created.ID = ""
+	body, err := c.submit(ctx, "add", query, form)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to add %s record %q: %w", rec.Type, rec.Name, err)
+	}
+	if c.dryRun {
+		return created, nil
+	}
+
+	// Tarka shows the domain's records after a change; failing to parse it
+	// only costs a fresh listing. Names are compared relative to the zone,
+	// which is looked up only if the listing doesn't match them as given.
+	listed, _ := parseRecords(body)
+	match, ok := newestMatch(listed, rec, "")
+	var zone string
+	if !ok {
+		zone = c.domainName(ctx, domainID)
+		match, ok = newestMatch(listed, rec, zone)
+	}
+	if !ok {
+		// Not every response includes the listing; look the new row up instead
+		listed, err := c.ListRecords(ctx, domainID)
+		if err != nil {
+			return Record{}, fmt.Errorf("added %s record %q but could not look up its ID: %w", rec.Type, rec.Name, err)
+		}
+		match, ok = newestMatch(listed, rec, zone)
+	}
+	if !ok {
+		return Record{}, fmt.Errorf("added %s record %q but could not find it in the listing of domain %s", rec.Type, rec.Name, domainID)
+	}
+	created = match
+	created.Name = rec.Name
+	return created, nil
+}
+
+// domainName returns the zone name of a domain, or "" if it can't be listed
+func (c *Client) domainName(ctx context.Context, domainID string) string {
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return ""
+	}
+	for _, domain := range domains {
+		if domain.ID == domainID {
+			return domain.Name
+		}
+	}
+	return ""
+}
+
+// UpdateRecord changes an existing record, identified by rec.ID, in place
+func (c *Client) UpdateRecord(ctx context.Context, domainID string, rec Record) error {
+	if rec.ID == "" {
+		return fmt.Errorf("cannot update %s record %q without an ID", rec.Type, rec.Name)
+	}
+	form, err := recordForm(domainID, rec)
+	if err != nil {
+		return err
+	}
+	form.Set("rr_id", rec.ID)
+
+	query := url.Values{"domain_id": {domainID}, "rr_id": {rec.ID}}
+	if _, err := c.submit(ctx, "update", query, form); err != nil {
+		return fmt.Errorf("failed to update record %s: %w", rec.ID, err)
+	}
+	return nil
+}
+
+// DeleteRecord removes a record from a domain by its ID
+func (c *Client) DeleteRecord(ctx context.Context, domainID, recordID string) error {
+	form := url.Values{}
+	form.Set("domain_id", domainID)
+	form.Set("rr_id", recordID)
+	form.Set("do_delete", "1")
+
+	query := url.Values{"domain_id": {domainID}, "rr_id": {recordID}}
+	if _, err := c.submit(ctx, "delete", query, form); err != nil {
+		return fmt.Errorf("failed to delete record %s: %w", recordID, err)
+	}
+	return nil
+}
+
+// submit posts a record edit form, returning the page Tarka responds with.
+// In dry-run mode the form is logged instead and nothing is returned.
+func (c *Client) submit(ctx context.Context, action string, query, form url.Values) ([]byte, error) {
+	if c.dryRun {
+		c.log.Info("dry run: not submitting record form",
+			zap.String("action", action),
+			zap.String("query", query.Encode()),
+			zap.String("form", form.Encode()))
+		return nil, nil
+	}
+
+	var body []byte
+	err := c.withSession(ctx, func() error {
+		var err error
+		body, err = c.postForm(ctx, "domain-rr-edit.php", query, form)
+		return err
+	})
+	return body, err
+}
+
+// recordForm builds the fields of the record edit form shared by adds and updates
+func recordForm(domainID string, rec Record) (url.Values, error) {
+	typeID, ok := recordTypeIDs[rec.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported record type %s", rec.Type)
+	}
+
+	// Convert TTL to seconds, default to empty string if not specified
+	ttlStr := ""
+	if rec.TTL > 0 {
+		ttlStr = strconv.Itoa(rec.TTL)
+	}
+
+	form := url.Values{}
+	form.Set("domain_id", domainID)
+	form.Set("do_change", "1")
+	form.Set("name", rec.Name)
+	form.Set("ttl", ttlStr)
+	form.Set("rr_type_id", typeID)
+	form.Set("data", rec.Data)
+	form.Set("caa_flags", "0")
+	form.Set("caa_tag", "issue")
+	form.Set("caa_value", "")
+	if rec.Type == "CAA" {
+		// CAA records are entered through their own fields rather than data
+		fields := strings.SplitN(rec.Data, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed CAA data %q", rec.Data)
+		}
+		form.Set("data", "")
+		form.Set("caa_flags", fields[0])
+		form.Set("caa_tag", fields[1])
+		form.Set("caa_value", strings.Trim(fields[2], `"`))
+	}
+	form.Set("expires", expiresField(rec.Expires))
+	return form, nil
+}
+
+// expiresField renders an expiry time as the relative form the web UI takes,
+// rounding up to whole minutes. The zero time leaves the field blank (never expires).
+func expiresField(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	minutes := int(math.Ceil(time.Until(expires).Minutes()))
+	if minutes < 1 {
+		minutes = 1
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// newestMatch finds the most recently created record (highest ID) matching
+// rec's name, type and data. Names are compared by relativeName, so listings
+// that differ in case or qualify names still match.
+func newestMatch(records []Record, rec Record, zone string) (Record, bool) {
+	var (
+		best   Record
+		bestID = -1
+		name   = relativeName(rec.Name, zone)
+	)
+	for _, r := range records {
+		if relativeName(r.Name, zone) != name || r.Type != rec.Type || r.Data != rec.Data {
+			continue
+		}
+		id, err := strconv.Atoi(r.ID)
+		if err != nil {
+			continue
+		}
+		if id > bestID {
+			best, bestID = r, id
+		}
+	}
+	return best, bestID >= 0
+}
+
+// relativeName lowercases a record name and makes it relative to zone, with
+// "" for the apex. With no zone only case, trailing dots and @ are handled.
+func relativeName(name, zone string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	switch {
+	case name == "@":
+		return ""
+	case zone == "":
+		return name
+	case name == zone:
+		return ""
+	}
+	return strings.TrimSuffix(name, "."+zone)
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestClient_ListDomains(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("77", "example.com")
+	server.AddDomain("78", "Example.NET")
+
+	domains, err := newTestClient(t, server).ListDomains(context.Background())
+	if err != nil {
+		t.Fatalf("ListDomains failed: %v", err)
+	}
+	want := []Domain{{ID: "77", Name: "example.com"}, {ID: "78", Name: "example.net"}}
+	if len(domains) != len(want) {
+		t.Fatalf("expected %d domains, got %+v", len(want), domains)
+	}
+	for i := range want {
+		if domains[i] != want[i] {
+			t.Errorf("expected domain %+v, got %+v", want[i], domains[i])
+		}
+	}
+}
+
+func TestClient_RecordLifecycle(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("77", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "77", Name: "", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+
+	ctx := context.Background()
+	c := newTestClient(t, server)
+
+	expires := time.Now().Add(10 * time.Minute)
+	created, err := c.AddRecord(ctx, "77", Record{Name: "_acme-challenge", Type: "TXT", TTL: 120, Data: "token", Expires: expires})
+	if err != nil {
+		t.Fatalf("AddRecord failed: %v", err)
+	}
+	if created.ID == "" {
+		t.Fatal("expected the created record to carry its ID")
+	}
+	if created.Expires.IsZero() || created.Expires.Sub(expires).Abs() > time.Minute {
+		t.Errorf("expected expiry near %v, got %v", expires, created.Expires)
+	}
+
+	records, err := c.ListRecords(ctx, "77")
+	if err != nil {
+		t.Fatalf("ListRecords failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	if apex := records[0]; apex.Name != "" || apex.Type != "A" || apex.TTL != 3600 || apex.Data != "192.0.2.1" || !apex.Expires.IsZero() {
+		t.Errorf("unexpected apex record %+v", apex)
+	}
+	if records[1].ID != created.ID || records[1].Data != "token" {
+		t.Errorf("expected listed TXT record to match created %+v, got %+v", created, records[1])
+	}
+
+	created.Data = "new-token"
+	created.TTL = 300
+	if err := c.UpdateRecord(ctx, "77", created); err != nil {
+		t.Fatalf("UpdateRecord failed: %v", err)
+	}
+	stored := server.Records("77")
+	if len(stored) != 2 || stored[1].Data != "new-token" || stored[1].TTL != 300 {
+		t.Errorf("expected record to be updated in place, got %+v", stored)
+	}
+
+	if err := c.DeleteRecord(ctx, "77", created.ID); err != nil {
+		t.Fatalf("DeleteRecord failed: %v", err)
+	}
+	if stored := server.Records("77"); len(stored) != 1 {
+		t.Errorf("expected 1 record after delete, got %+v", stored)
+	}
+
+	if err := c.DeleteRecord(ctx, "77", created.ID); err == nil {
+		t.Error("expected deleting a missing record to fail")
+	}
+}
+
+func TestClient_AddRecord_CAA(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("77", "example.com")
+
+	c := newTestClient(t, server)
+	_, err := c.AddRecord(context.Background(), "77", Record{Type: "CAA", Data: `0 issue "letsencrypt.org"`})
+	if err != nil {
+		t.Fatalf("AddRecord failed: %v", err)
+	}
+	if stored := server.Records("77"); len(stored) != 1 || stored[0].Data != `0 issue "letsencrypt.org"` {
+		t.Errorf("unexpected stored CAA record %+v", stored)
+	}
+
+	if _, err := c.AddRecord(context.Background(), "77", Record{Type: "HINFO", Data: "x"}); err == nil {
+		t.Error("expected an unsupported record type to be rejected")
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	body := []byte(`<html><body>
+		<table class="nav"><tr><td><a href="customer-view.php">Home</a></td></tr></table>
+		<table>
+			<tr><th>Type</th><th>Name</th><th>Data</th><th>TTL</th><th>Expires</th><th>Actions</th></tr>
+			<tr>
+				<td>txt</td><td> _acme-challenge.app </td><td>a &amp; b</td><td></td>
+				<td>2026-10-18 10:00:00</td>
+				<td><a href="domain-rr-edit.php?domain_id=77&amp;rr_id=1234">edit</a></td>
+			</tr>
+			<tr><td>MX</td><td>@</td><td>10 mail.example.com.</td><td>3600</td><td>never</td><td></td></tr>
+		</table>
+	</body></html>`)
+
+	records, err := parseRecords(body)
+	if err != nil {
+		t.Fatalf("parseRecords failed: %v", err)
+	}
+	want := []Record{
+		{ID: "1234", Name: "_acme-challenge.app", Type: "TXT", Data: "a & b", Expires: time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)},
+		{Name: "", Type: "MX", TTL: 3600, Data: "10 mail.example.com."},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %+v", len(want), records)
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("record %d: expected %+v, got %+v", i, want[i], records[i])
+		}
+	}
+
+	if _, err := parseRecords([]byte(`<html><body>Login Page</body></html>`)); err == nil {
+		t.Error("expected an error for a page without a record table")
+	}
+}
+
+func TestClient_AddRecord_QualifiedListing(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("77", "example.com")
+	server.QualifyNames()
+
+	ctx := context.Background()
+	c := newTestClient(t, server)
+	for _, name := range []string{"", "WWW"} {
+		created, err := c.AddRecord(ctx, "77", Record{Name: name, Type: "TXT", Data: "token"})
+		if err != nil {
+			t.Fatalf("AddRecord %q failed: %v", name, err)
+		}
+		if created.ID == "" || created.Name != name {
+			t.Errorf("expected record %q to carry its ID, got %+v", name, created)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// defaultUserAgent identifies us to Tarka unless overridden
+	defaultUserAgent = "caddy-dns-tarka"
+
+	defaultDialTimeout     = 10 * time.Second
+	defaultResponseTimeout = 30 * time.Second
+)
+
+// tlsVersions maps the accepted tls_min_version values to crypto/tls constants,
+// using the same names as Caddy's own tls protocols option.
+var tlsVersions = map[string]uint16{
+	"tls1.2": tls.VersionTLS12,
+	"tls1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a tls_min_version value to its crypto/tls constant
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tls_min_version %q", name)
+	}
+	return version, nil
+}
+
+// TransportConfig customises the HTTP client shared by every request to Tarka
+type TransportConfig struct {
+	// Proxy is the URL of an HTTP(S) proxy to send requests through
+	// (defaults to the HTTP_PROXY/HTTPS_PROXY environment variables)
+	Proxy string `json:"proxy,omitempty"`
+
+	// CAFile is a PEM bundle of extra certificate authorities to trust,
+	// e.g. for an internal mirror of Tarka
+	CAFile string `json:"ca_file,omitempty"`
+
+	// TLSMinVersion is the minimum TLS version, either tls1.2 or tls1.3 (defaults to tls1.2)
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+
+	// DialTimeout limits how long establishing a connection may take (defaults to 10s)
+	DialTimeout time.Duration `json:"dial_timeout,omitempty"`
+
+	// ResponseTimeout limits how long a whole request may take (defaults to 30s)
+	ResponseTimeout time.Duration `json:"response_timeout,omitempty"`
+
+	// UserAgent is sent with every request (defaults to caddy-dns-tarka)
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// Headers are extra HTTP headers sent with every request
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// newHTTPClient builds the HTTP client used for all requests to Tarka.
+// A nil config gives the defaults.
+func newHTTPClient(cfg *TransportConfig) (*http.Client, error) {
+	if cfg == nil {
+		cfg = new(TransportConfig)
+	}
+
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	responseTimeout := cfg.ResponseTimeout
+	if responseTimeout == 0 {
+		responseTimeout = defaultResponseTimeout
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSMinVersion != "" {
+		version, err := ParseTLSVersion(cfg.TLSMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: scheme and host are required", cfg.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   dialTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %w", err)
+	}
+
+	return &http.Client{
+		Transport: &headerTransport{
+			base:      transport,
+			userAgent: userAgent,
+			headers:   cfg.Headers,
+		},
+		Jar:     &sessionJar{CookieJar: jar},
+		Timeout: responseTimeout,
+	}, nil
+}
+
+// headerTransport sets the configured User-Agent and extra headers on every request
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	headers   map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewHTTPClient_Headers(t *testing.T) {
+	var gotUA, gotHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.UserAgent()
+		gotHeader = r.Header.Get("X-Team")
+	}))
+	defer server.Close()
+
+	t.Run("defaults", func(t *testing.T) {
+		client, err := newHTTPClient(nil)
+		if err != nil {
+			t.Fatalf("newHTTPClient failed: %v", err)
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if gotUA != defaultUserAgent {
+			t.Errorf("expected User-Agent %q, got %q", defaultUserAgent, gotUA)
+		}
+		if client.Timeout != defaultResponseTimeout {
+			t.Errorf("expected timeout %v, got %v", defaultResponseTimeout, client.Timeout)
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		client, err := newHTTPClient(&TransportConfig{
+			UserAgent: "dns-team/1.0",
+			Headers:   map[string]string{"X-Team": "dns"},
+		})
+		if err != nil {
+			t.Fatalf("newHTTPClient failed: %v", err)
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if gotUA != "dns-team/1.0" {
+			t.Errorf("expected custom User-Agent, got %q", gotUA)
+		}
+		if gotHeader != "dns" {
+			t.Errorf("expected X-Team header 'dns', got %q", gotHeader)
+		}
+	})
+}
+
+func TestNewHTTPClient_CAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Without the test server's CA the request must fail verification
+	client, err := newHTTPClient(nil)
+	if err != nil {
+		t.Fatalf("newHTTPClient failed: %v", err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatal("expected certificate verification to fail without the CA file")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = newHTTPClient(&TransportConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("newHTTPClient failed: %v", err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected request to succeed with the CA file, got: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewHTTPClient_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *TransportConfig
+		wantErr string
+	}{
+		{
+			name:    "unsupported TLS version",
+			config:  &TransportConfig{TLSMinVersion: "tls1.0"},
+			wantErr: "unsupported tls_min_version",
+		},
+		{
+			name:    "proxy without scheme",
+			config:  &TransportConfig{Proxy: "proxy.internal:3128"},
+			wantErr: "invalid proxy URL",
+		},
+		{
+			name:    "missing CA file",
+			config:  &TransportConfig{CAFile: "/nonexistent/ca.pem"},
+			wantErr: "failed to read CA file",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newHTTPClient(tc.config)
+			if err == nil {
+				t.Fatal("expected an error but got none")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected error to contain '%s', got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxTXTStringLength is the longest a single TXT character string may be (RFC 1035 §3.3)
+const maxTXTStringLength = 255
+
+// EncodeTXT converts TXT record text to the data the web UI takes. Short
+// text without quotes or backslashes is sent as-is, which is what Tarka has
+// always accepted. Anything else is written in zone file presentation form,
+// as QuoteTXT does.
+func EncodeTXT(text string) string {
+	if len(text) <= maxTXTStringLength && !strings.ContainsAny(text, `"\`) {
+		return text
+	}
+	return QuoteTXT(text)
+}
+
+// QuoteTXT converts TXT record text to zone file presentation form: quoted
+// character strings of at most 255 bytes each, separated by spaces, with
+// quotes, backslashes and non-printable bytes escaped.
+func QuoteTXT(text string) string {
+	var sb strings.Builder
+	for _, chunk := range splitTXT(text) {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteByte('"')
+		for i := 0; i < len(chunk); i++ {
+			b := chunk[i]
+			switch {
+			case b == '"' || b == '\\':
+				sb.WriteByte('\\')
+				sb.WriteByte(b)
+			case b < ' ' || b == 0x7f:
+				fmt.Fprintf(&sb, "\\%03d", b)
+			default:
+				sb.WriteByte(b)
+			}
+		}
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+// DecodeTXT reverses EncodeTXT, joining quoted character strings back into
+// a single text. Data that does not start with a quote is returned as-is.
+func DecodeTXT(data string) (string, error) {
+	if !strings.HasPrefix(data, `"`) {
+		return data, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(data); {
+		switch data[i] {
+		case ' ', '\t':
+			i++
+			continue
+		case '"':
+		default:
+			return "", fmt.Errorf("unexpected %q outside quoted TXT string at offset %d", data[i], i)
+		}
+
+		// Read one quoted character string
+		i++
+		for {
+			if i >= len(data) {
+				return "", fmt.Errorf("unterminated quoted TXT string")
+			}
+			b := data[i]
+			if b == '"' {
+				i++
+				break
+			}
+			if b != '\\' {
+				sb.WriteByte(b)
+				i++
+				continue
+			}
+			b, n, err := unescape(data[i:])
+			if err != nil {
+				return "", err
+			}
+			sb.WriteByte(b)
+			i += n
+		}
+	}
+	return sb.String(), nil
+}
+
+// UnescapeTXT converts the contents of one character string in zone file
+// presentation form, without its quotes, to text, undoing \X and \DDD
+// escapes as RFC 1035 describes
+func UnescapeTXT(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			i++
+			continue
+		}
+		b, n, err := unescape(s[i:])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(b)
+		i += n
+	}
+	return sb.String(), nil
+}
+
+// unescape reads the escape at the start of s, returning the byte it stands
+// for and its length
+func unescape(s string) (byte, int, error) {
+	if len(s) < 2 {
+		return 0, 0, fmt.Errorf("dangling escape in TXT string")
+	}
+	if !isDigit(s[1]) {
+		return s[1], 2, nil
+	}
+	if len(s) < 4 || !isDigit(s[2]) || !isDigit(s[3]) {
+		return 0, 0, fmt.Errorf("malformed \\DDD escape in TXT string")
+	}
+	n, _ := strconv.Atoi(s[1:4])
+	if n > 255 {
+		return 0, 0, fmt.Errorf("escape \\%s out of range in TXT string", s[1:4])
+	}
+	return byte(n), 4, nil
+}
+
+// splitTXT splits text into chunks of at most 255 bytes, without splitting
+// a UTF-8 sequence across chunks where it can be avoided
+func splitTXT(text string) []string {
+	var chunks []string
+	for len(text) > maxTXTStringLength {
+		cut := maxTXTStringLength
+		for cut > maxTXTStringLength-utf8.UTFMax && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if !utf8.RuneStart(text[cut]) {
+			// Not valid UTF-8; split on the byte boundary
+			cut = maxTXTStringLength
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+	return append(chunks, text)
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
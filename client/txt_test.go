@@ -0,0 +1,77 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeTXT(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "short", text: "acme-token", want: "acme-token"},
+		{name: "spaces", text: "v=spf1 -all", want: "v=spf1 -all"},
+		{name: "quotes", text: `say "hi"`, want: `"say \"hi\""`},
+		{name: "backslash", text: `a\b`, want: `"a\\b"`},
+		{name: "control", text: "a\tb", want: "a\tb"},
+		{name: "control when quoted", text: "a\t\"", want: `"a\009\""`},
+		{name: "long", text: long, want: `"` + long[:255] + `" "` + long[255:] + `"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := EncodeTXT(tc.text); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTXTRoundTrip(t *testing.T) {
+	dkim := "v=DKIM1; k=rsa; p=" + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA", 12)
+	texts := []string{
+		"",
+		"token",
+		dkim,
+		`quote " and backslash \ ` + strings.Repeat("x", 260),
+		strings.Repeat("é", 200), // 400 bytes of two-byte runes
+		"\"starts with a quote",
+	}
+
+	for _, text := range texts {
+		encoded := EncodeTXT(text)
+		decoded, err := DecodeTXT(encoded)
+		if err != nil {
+			t.Errorf("DecodeTXT(%q) failed: %v", encoded, err)
+			continue
+		}
+		if decoded != text {
+			t.Errorf("round trip changed %q to %q", text, decoded)
+		}
+		if strings.HasPrefix(encoded, `"`) {
+			for _, chunk := range splitTXT(text) {
+				if len(chunk) > maxTXTStringLength {
+					t.Errorf("chunk of %d bytes exceeds the limit", len(chunk))
+				}
+			}
+		}
+	}
+
+	// Multi-byte runes are not split across character strings
+	for _, chunk := range splitTXT(strings.Repeat("é", 200)) {
+		if !strings.HasPrefix(chunk, "é") {
+			t.Errorf("chunk %q starts mid-rune", chunk[:2])
+		}
+	}
+}
+
+func TestDecodeTXT_Invalid(t *testing.T) {
+	for _, data := range []string{`"unterminated`, `"a" b`, `"dangling\`, `"\25"`, `"\999"`} {
+		if _, err := DecodeTXT(data); err == nil {
+			t.Errorf("expected DecodeTXT(%q) to fail", data)
+		}
+	}
+}
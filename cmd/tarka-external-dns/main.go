@@ -0,0 +1,109 @@
+// Command tarka-external-dns is an external-dns webhook provider for Tarka
+// DNS. It runs next to external-dns, which is started with --provider=webhook
+// and sends it the records to list and change.
+//
+// The webhook listens on localhost:8888, where external-dns expects it, and
+// answers health checks on /healthz at :8080. It is configured with flags or
+// the environment variables named in their help.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/nsna/tarka"
+	"go.uber.org/zap"
+)
+
+func main() {
+	var (
+		username      = flag.String("username", os.Getenv("TARKA_USERNAME"), "Tarka username (TARKA_USERNAME)")
+		password      = flag.String("password", os.Getenv("TARKA_PASSWORD"), "Tarka password (TARKA_PASSWORD)")
+		baseURL       = flag.String("base-url", os.Getenv("TARKA_BASE_URL"), "Base URL of the Tarka customer area (TARKA_BASE_URL)")
+		domainFilter  = flag.String("domain-filter", os.Getenv("DOMAIN_FILTER"), "Comma-separated domains to manage (DOMAIN_FILTER)")
+		excludeFilter = flag.String("exclude-domains", os.Getenv("EXCLUDE_DOMAINS"), "Comma-separated domains not to manage (EXCLUDE_DOMAINS)")
+		listen        = flag.String("listen", "localhost:8888", "Address to serve the webhook on")
+		healthListen  = flag.String("health-listen", ":8080", "Address to serve /healthz on")
+	)
+	flag.Parse()
+
+	log := caddy.Log().Named("tarka-external-dns")
+	if err := run(log, *username, *password, *baseURL, newDomainFilter(splitList(*domainFilter), splitList(*excludeFilter)), *listen, *healthListen); err != nil {
+		log.Fatal("tarka-external-dns failed", zap.Error(err))
+	}
+}
+
+func run(log *zap.Logger, username, password, baseURL string, filter DomainFilter, listen, healthListen string) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("--username and --password (or TARKA_USERNAME and TARKA_PASSWORD) are required")
+	}
+
+	// external-dns keeps its own record of the records it owns in TXT
+	// records, so the provider may delete records it didn't create; its
+	// ledger wouldn't survive the pod being replaced anyway
+	p := &tarka.Provider{
+		Username:      username,
+		Password:      password,
+		BaseURL:       baseURL,
+		DeleteUnowned: true,
+	}
+	ctx, cancel := tarka.StandaloneContext(context.Background(), nil)
+	defer cancel()
+	if err := p.Provision(ctx); err != nil {
+		return fmt.Errorf("provisioning provider: %w", err)
+	}
+	defer p.Cleanup()
+
+	health := http.NewServeMux()
+	health.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	servers := []*http.Server{
+		{Addr: listen, Handler: newWebhook(p, filter, log), ReadHeaderTimeout: 10 * time.Second},
+		{Addr: healthListen, Handler: health, ReadHeaderTimeout: 10 * time.Second},
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+	log.Info("Serving external-dns webhook", zap.String("address", listen), zap.Strings("domains", filter.Include))
+
+	var err error
+	select {
+	case <-sigCtx.Done():
+	case err = <-errs:
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+	return err
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			out = append(out, field)
+		}
+	}
+	return out
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+// mediaType is the content type of the external-dns webhook protocol
+const mediaType = "application/external.dns.webhook+json;version=1"
+
+// Endpoint is external-dns's description of an RRset: a name, a type and
+// its targets
+type Endpoint struct {
+	DNSName          string                     `json:"dnsName,omitempty"`
+	Targets          []string                   `json:"targets,omitempty"`
+	RecordType       string                     `json:"recordType,omitempty"`
+	SetIdentifier    string                     `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                      `json:"recordTTL,omitempty"`
+	Labels           map[string]string          `json:"labels,omitempty"`
+	ProviderSpecific []ProviderSpecificProperty `json:"providerSpecific,omitempty"`
+}
+
+// ProviderSpecificProperty is an endpoint option for a particular provider
+type ProviderSpecificProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Changes are the endpoints external-dns wants created, updated and deleted.
+// UpdateOld holds the endpoints in UpdateNew as they were before.
+type Changes struct {
+	Create    []*Endpoint `json:"create,omitempty"`
+	UpdateOld []*Endpoint `json:"updateOld,omitempty"`
+	UpdateNew []*Endpoint `json:"updateNew,omitempty"`
+	Delete    []*Endpoint `json:"delete,omitempty"`
+}
+
+// DomainFilter limits the names the webhook manages. A name matches a domain
+// if it is the domain or a subdomain of it; with no Include domains, every
+// name that matches no Exclude domain does.
+type DomainFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// newDomainFilter returns a filter for the given domains, dropping empty ones
+func newDomainFilter(include, exclude []string) DomainFilter {
+	normalize := func(domains []string) []string {
+		var out []string
+		for _, domain := range domains {
+			if domain = canonicalName(domain); domain != "" {
+				out = append(out, domain)
+			}
+		}
+		return out
+	}
+	return DomainFilter{Include: normalize(include), Exclude: normalize(exclude)}
+}
+
+// Match reports whether the filter lets the webhook manage name
+func (f DomainFilter) Match(name string) bool {
+	name = canonicalName(name)
+	if len(f.Include) > 0 && !slices.ContainsFunc(f.Include, func(domain string) bool { return inDomain(name, domain) }) {
+		return false
+	}
+	return !slices.ContainsFunc(f.Exclude, func(domain string) bool { return inDomain(name, domain) })
+}
+
+// matchZone reports whether any name in zone can match the filter
+func (f DomainFilter) matchZone(zone string) bool {
+	if slices.ContainsFunc(f.Exclude, func(domain string) bool { return inDomain(zone, domain) }) {
+		return false
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(f.Include, func(domain string) bool {
+		return inDomain(zone, domain) || inDomain(domain, zone)
+	})
+}
+
+// inDomain reports whether name is domain or a subdomain of it
+func inDomain(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// canonicalName returns name in lowercase without leading or trailing dots
+func canonicalName(name string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(name), "."))
+}
+
+// webhook serves the external-dns webhook protocol on top of a provider
+type webhook struct {
+	provider *tarka.Provider
+	filter   DomainFilter
+	log      *zap.Logger
+}
+
+// newWebhook returns the handler for the webhook endpoints
+func newWebhook(p *tarka.Provider, filter DomainFilter, log *zap.Logger) http.Handler {
+	h := &webhook{provider: p, filter: filter, log: log}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", h.negotiate)
+	mux.HandleFunc("GET /records", h.records)
+	mux.HandleFunc("POST /records", h.applyChanges)
+	mux.HandleFunc("POST /adjustendpoints", h.adjustEndpoints)
+	return mux
+}
+
+// negotiate tells external-dns the domains the webhook manages
+func (h *webhook) negotiate(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, h.filter)
+}
+
+// records lists the RRsets in the zones that match the filter
+func (h *webhook) records(w http.ResponseWriter, r *http.Request) {
+	zones, err := h.zones(r.Context())
+	if err != nil {
+		h.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	endpoints := []*Endpoint{}
+	for _, zone := range zones {
+		records, err := h.provider.GetRecords(r.Context(), zone)
+		if err != nil {
+			h.fail(w, http.StatusInternalServerError, fmt.Errorf("failed to list records of %s: %w", zone, err))
+			return
+		}
+		endpoints = append(endpoints, h.toEndpoints(zone, records)...)
+	}
+	h.writeJSON(w, endpoints)
+}
+
+// toEndpoints groups the records the filter matches into one endpoint per
+// name and type
+func (h *webhook) toEndpoints(zone string, records []libdns.Record) []*Endpoint {
+	var endpoints []*Endpoint
+	byKey := make(map[string]*Endpoint)
+	for _, record := range records {
+		rr := record.RR()
+		name := canonicalName(libdns.AbsoluteName(rr.Name, zone+"."))
+		if !h.filter.Match(name) {
+			continue
+		}
+		key := name + "/" + rr.Type
+		ep, ok := byKey[key]
+		if !ok {
+			ep = &Endpoint{DNSName: name, RecordType: rr.Type, RecordTTL: int64(rr.TTL.Seconds())}
+			byKey[key] = ep
+			endpoints = append(endpoints, ep)
+		}
+		ep.Targets = append(ep.Targets, rr.Data)
+	}
+	return endpoints
+}
+
+// applyChanges makes the changes external-dns planned. Every endpoint is
+// checked before any change is made; deletes are made first, so a name can
+// change type, then updates, then creates.
+func (h *webhook) applyChanges(w http.ResponseWriter, r *http.Request) {
+	var changes Changes
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		h.fail(w, http.StatusBadRequest, fmt.Errorf("invalid changes: %w", err))
+		return
+	}
+	zones, err := h.zones(r.Context())
+	if err != nil {
+		h.fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Group the changes by zone. UpdateOld is not needed: SetRecords replaces
+	// the RRsets in UpdateNew whatever they held before.
+	type batch struct{ deletes, updates, creates []libdns.Record }
+	batches := make(map[string]*batch)
+	var order []string
+	for _, group := range []struct {
+		endpoints []*Endpoint
+		add       func(*batch, []libdns.Record)
+	}{
+		{changes.Delete, func(b *batch, records []libdns.Record) { b.deletes = append(b.deletes, records...) }},
+		{changes.UpdateNew, func(b *batch, records []libdns.Record) { b.updates = append(b.updates, records...) }},
+		{changes.Create, func(b *batch, records []libdns.Record) { b.creates = append(b.creates, records...) }},
+	} {
+		for _, ep := range group.endpoints {
+			zone, err := h.zoneFor(zones, ep.DNSName)
+			if err != nil {
+				h.fail(w, http.StatusBadRequest, err)
+				return
+			}
+			if batches[zone] == nil {
+				batches[zone] = new(batch)
+				order = append(order, zone)
+			}
+			group.add(batches[zone], toRecords(ep))
+		}
+	}
+
+	ctx := r.Context()
+	for _, zone := range order {
+		b := batches[zone]
+		if len(b.deletes) > 0 {
+			if _, err := h.provider.DeleteRecords(ctx, zone, b.deletes); err != nil {
+				h.fail(w, http.StatusInternalServerError, fmt.Errorf("failed to delete records in %s: %w", zone, err))
+				return
+			}
+		}
+		if len(b.updates) > 0 {
+			if _, err := h.provider.SetRecords(ctx, zone, b.updates); err != nil {
+				h.fail(w, http.StatusInternalServerError, fmt.Errorf("failed to update records in %s: %w", zone, err))
+				return
+			}
+		}
+		if len(b.creates) > 0 {
+			if _, err := h.provider.AppendRecords(ctx, zone, b.creates); err != nil {
+				h.fail(w, http.StatusInternalServerError, fmt.Errorf("failed to create records in %s: %w", zone, err))
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toRecords returns one record per target of an endpoint. Names are given
+// fully qualified, which the provider accepts.
+func toRecords(ep *Endpoint) []libdns.Record {
+	records := make([]libdns.Record, 0, len(ep.Targets))
+	for _, target := range ep.Targets {
+		records = append(records, libdns.RR{
+			Name: canonicalName(ep.DNSName),
+			Type: ep.RecordType,
+			TTL:  time.Duration(ep.RecordTTL) * time.Second,
+			Data: target,
+		})
+	}
+	return records
+}
+
+// adjustEndpoints puts desired endpoints in the form the records endpoint
+// returns them in, so external-dns doesn't plan changes Tarka can't make:
+// names are lowercased, TTLs clamped to Tarka's limits and endpoints of
+// types Tarka doesn't support dropped.
+func (h *webhook) adjustEndpoints(w http.ResponseWriter, r *http.Request) {
+	var endpoints []*Endpoint
+	if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+		h.fail(w, http.StatusBadRequest, fmt.Errorf("invalid endpoints: %w", err))
+		return
+	}
+
+	adjusted := make([]*Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if !client.IsSupportedType(ep.RecordType) {
+			h.log.Warn("Ignoring endpoint of unsupported type", zap.String("name", ep.DNSName), zap.String("type", ep.RecordType))
+			continue
+		}
+		ep.DNSName = canonicalName(ep.DNSName)
+		if ep.RecordTTL != 0 {
+			ep.RecordTTL = min(max(ep.RecordTTL, client.MinTTL), client.MaxTTL)
+		}
+		adjusted = append(adjusted, ep)
+	}
+	h.writeJSON(w, adjusted)
+}
+
+// zones returns the zones in the account that match the filter, longest
+// first, so the first zone a name is in is the most specific
+func (h *webhook) zones(ctx context.Context) ([]string, error) {
+	listed, err := h.provider.GetZones(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zones: %w", err)
+	}
+	var zones []string
+	for _, zone := range listed {
+		if name := canonicalName(zone.Name); h.filter.matchZone(name) {
+			zones = append(zones, name)
+		}
+	}
+	slices.SortFunc(zones, func(a, b string) int { return len(b) - len(a) })
+	return zones, nil
+}
+
+// zoneFor returns the zone to change name in, if the filter matches it
+func (h *webhook) zoneFor(zones []string, name string) (string, error) {
+	name = canonicalName(name)
+	if !h.filter.Match(name) {
+		return "", fmt.Errorf("%s is outside the domain filter", name)
+	}
+	for _, zone := range zones {
+		if inDomain(name, zone) {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("no zone in the account holds %s", name)
+}
+
+// writeJSON writes v as a webhook response
+func (h *webhook) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", mediaType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.log.Debug("failed to write response", zap.Error(err))
+	}
+}
+
+// fail logs err and returns it to external-dns
+func (h *webhook) fail(w http.ResponseWriter, code int, err error) {
+	h.log.Error("webhook request failed", zap.Error(err))
+	http.Error(w, err.Error(), code)
+}
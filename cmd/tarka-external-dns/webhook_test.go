@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/nsna/tarka"
+	"github.com/nsna/tarka/client"
+	"github.com/nsna/tarka/internal/tarkatest"
+	"go.uber.org/zap"
+)
+
+func TestWebhook(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddDomain("124", "example.org")
+	wwwID := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "internal", Type: "A", TTL: 3600, Data: "10.0.0.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "124", Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.9"})
+
+	p := &tarka.Provider{
+		Username:      tarkatest.Username,
+		Password:      tarkatest.Password,
+		BaseURL:       server.BaseURL(),
+		DeleteUnowned: true,
+	}
+	ctx, cancel := tarka.StandaloneContext(context.Background(), nil)
+	defer cancel()
+	if err := p.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	filter := newDomainFilter([]string{"example.com"}, []string{"internal.example.com"})
+	webhook := httptest.NewServer(newWebhook(p, filter, zap.NewNop()))
+	defer webhook.Close()
+
+	do := func(method, path string, body any, out any) int {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&buf).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req, err := http.NewRequest(method, webhook.URL+path, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", mediaType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if ct := resp.Header.Get("Content-Type"); ct != mediaType {
+				t.Errorf("expected content type %s, got %s", mediaType, ct)
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("failed to decode %s %s: %v", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	// Negotiation returns the domain filter
+	var negotiated DomainFilter
+	do(http.MethodGet, "/", nil, &negotiated)
+	if !reflect.DeepEqual(negotiated, filter) {
+		t.Errorf("expected filter %+v, got %+v", filter, negotiated)
+	}
+
+	// Only records the filter matches are listed
+	var endpoints []*Endpoint
+	do(http.MethodGet, "/records", nil, &endpoints)
+	want := []*Endpoint{{DNSName: "www.example.com", RecordType: "A", RecordTTL: 3600, Targets: []string{"192.0.2.1"}}}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Fatalf("expected %+v, got %+v", want[0], endpoints)
+	}
+
+	// Endpoints are adjusted to what Tarka accepts
+	var adjusted []*Endpoint
+	do(http.MethodPost, "/adjustendpoints", []*Endpoint{
+		{DNSName: "App.Example.com.", RecordType: "A", RecordTTL: 1, Targets: []string{"192.0.2.10"}},
+		{DNSName: "svc.example.com", RecordType: "NAPTR", Targets: []string{"x"}},
+	}, &adjusted)
+	if len(adjusted) != 1 || adjusted[0].DNSName != "app.example.com" || adjusted[0].RecordTTL != client.MinTTL {
+		t.Errorf("unexpected adjusted endpoints %+v", adjusted)
+	}
+
+	// Changes are applied: www is edited in place, app and its registry
+	// record are created
+	registry := `"heritage=external-dns,external-dns/owner=default,external-dns/resource=service/default/app"`
+	changes := Changes{
+		Create: []*Endpoint{
+			{DNSName: "app.example.com", RecordType: "A", RecordTTL: 300, Targets: []string{"192.0.2.10", "192.0.2.11"}},
+			{DNSName: "a-app.example.com", RecordType: "TXT", RecordTTL: 300, Targets: []string{registry}},
+		},
+		UpdateOld: []*Endpoint{{DNSName: "www.example.com", RecordType: "A", RecordTTL: 3600, Targets: []string{"192.0.2.1"}}},
+		UpdateNew: []*Endpoint{{DNSName: "www.example.com", RecordType: "A", RecordTTL: 3600, Targets: []string{"192.0.2.2"}}},
+	}
+	if code := do(http.MethodPost, "/records", changes, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	for _, rec := range server.Records("123") {
+		if rec.Name == "www" && (rec.ID != wwwID || rec.Data != "192.0.2.2") {
+			t.Errorf("expected www to be edited in place, got %+v", rec)
+		}
+	}
+	if n := len(server.Records("123")); n != 5 {
+		t.Errorf("expected 5 records, got %d", n)
+	}
+
+	// The registry record reads back as external-dns wrote it
+	do(http.MethodGet, "/records", nil, &endpoints)
+	found := false
+	for _, ep := range endpoints {
+		if ep.DNSName == "a-app.example.com" {
+			found = reflect.DeepEqual(ep.Targets, []string{registry})
+		}
+	}
+	if !found {
+		t.Errorf("expected the TXT record to round trip, got %+v", endpoints)
+	}
+
+	// Names outside the filter are refused before anything changes
+	outside := Changes{
+		Delete: []*Endpoint{{DNSName: "app.example.com", RecordType: "A", Targets: []string{"192.0.2.10", "192.0.2.11"}}},
+		Create: []*Endpoint{{DNSName: "www.example.org", RecordType: "A", Targets: []string{"192.0.2.8"}}},
+	}
+	if code := do(http.MethodPost, "/records", outside, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", code)
+	}
+	if n := len(server.Records("123")); n != 5 {
+		t.Errorf("expected no changes, got %d records", n)
+	}
+
+	// Deleting app removes both of its records
+	outside.Create = nil
+	if code := do(http.MethodPost, "/records", outside, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if n := len(server.Records("123")); n != 3 {
+		t.Errorf("expected 3 records, got %d", n)
+	}
+}
+
+func TestDomainFilter(t *testing.T) {
+	filter := newDomainFilter([]string{"example.com", " "}, []string{"private.example.com."})
+	for name, want := range map[string]bool{
+		"example.com":           true,
+		"WWW.example.com.":      true,
+		"notexample.com":        false,
+		"private.example.com":   false,
+		"a.private.example.com": false,
+		"example.org":           false,
+	} {
+		if got := filter.Match(name); got != want {
+			t.Errorf("Match(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if !filter.matchZone("com") || !filter.matchZone("sub.example.com") || filter.matchZone("example.org") {
+		t.Error("unexpected zone matches")
+	}
+	if !(DomainFilter{}).Match("anything.example") {
+		t.Error("expected an empty filter to match everything")
+	}
+}
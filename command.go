@@ -0,0 +1,288 @@
+package tarka
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "tarka",
+		Usage: "<command> [--username <user>] [--password <pass>] [--base-url <url>] [--domain-id <id>]",
+		Short: "Works with zones in a Tarka DNS account",
+		Long: `
+Works with zones in a Tarka DNS account directly, without running Caddy.
+
+--username and --password default to the TARKA_USERNAME and TARKA_PASSWORD
+environment variables. --domain-id is only needed when the zone name isn't
+enough to find the domain in the account.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.PersistentFlags().String("username", os.Getenv("TARKA_USERNAME"), "Tarka username")
+			cmd.PersistentFlags().String("password", os.Getenv("TARKA_PASSWORD"), "Tarka password")
+			cmd.PersistentFlags().String("base-url", "", "Base URL of the Tarka customer area")
+			cmd.PersistentFlags().String("domain-id", "", "Tarka domain ID of the zone")
+
+			export := &cobra.Command{
+				Use:   "export --zone <zone> [--output <file>]",
+				Short: "Writes a zone as an RFC 1035 zone file",
+				RunE:  caddycmd.WrapCommandFuncForCobra(cmdExport),
+			}
+			export.Flags().String("zone", "", "Zone to export, e.g. example.com")
+			export.Flags().StringP("output", "o", "", "File to write to (defaults to stdout)")
+			cmd.AddCommand(export)
+
+			importCmd := &cobra.Command{
+				Use:   "import --zone <zone> --file <zonefile> [--yes] [--keep-existing]",
+				Short: "Makes a zone match an RFC 1035 zone file",
+				Long: `
+Parses a zone file, compares it with the zone in Tarka and prints the records
+that would be added, updated and deleted, then asks before making the changes.
+Records of types Tarka doesn't support are listed first and skipped.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdImport),
+			}
+			importCmd.Flags().String("zone", "", "Zone to import into, e.g. example.com")
+			importCmd.Flags().StringP("file", "f", "", "Zone file to import")
+			importCmd.Flags().BoolP("yes", "y", false, "Apply the plan without asking")
+			importCmd.Flags().Bool("keep-existing", false, "Keep records of names and types not in the file")
+			cmd.AddCommand(importCmd)
+
+			syncCmd := &cobra.Command{
+				Use:   "sync --file <state> [--apply] [--prune] [--owner <owner>]",
+				Short: "Reconciles a zone with a YAML or JSON desired state file",
+				Long: `
+Compares the records declared in a desired state file with the zone in Tarka
+and prints the plan. Only the names and types the file declares are managed;
+each gets a TXT ownership marker at _tarka-owner.<name>, and other records
+are never touched. With --prune, records the owner marked before but the
+file no longer declares are deleted.
+
+Without --apply, nothing is changed and the exit status is 2 if the zone has
+drifted from the file, so the command can gate CI. With --apply, the plan is
+applied without asking.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdSync),
+			}
+			syncCmd.Flags().StringP("file", "f", "", "Desired state file (.json for JSON, YAML otherwise)")
+			syncCmd.Flags().Bool("apply", false, "Apply the plan instead of only printing it")
+			syncCmd.Flags().Bool("prune", false, "Delete owned records the file no longer declares")
+			syncCmd.Flags().String("owner", "", "Owner to record in markers (overrides the file's owner)")
+			cmd.AddCommand(syncCmd)
+
+			rollback := &cobra.Command{
+				Use:   "rollback --zone <zone> [--snapshot <name>] [--dir <path>] [--yes]",
+				Short: "Restores a zone from a snapshot",
+				Long: `
+Restores a zone to a snapshot taken before an earlier change. Without
+--snapshot, the zone's snapshots are listed, oldest first. Otherwise the
+command prints the plan that restores the snapshot and asks before applying
+it; the current zone is snapshotted first, so a rollback can be undone too.
+
+Snapshots are read from --dir, or from Caddy's default storage when the
+snapshots config has no dir.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdRollback),
+			}
+			rollback.Flags().String("zone", "", "Zone to restore, e.g. example.com")
+			rollback.Flags().String("snapshot", "", "Name of the snapshot to restore")
+			rollback.Flags().String("dir", "", "Directory the snapshots are kept in")
+			rollback.Flags().BoolP("yes", "y", false, "Apply the plan without asking")
+			cmd.AddCommand(rollback)
+		},
+	})
+}
+
+// providerFromFlags returns a provider configured from the command's flags
+func providerFromFlags(fl caddycmd.Flags) (*Provider, error) {
+	p := &Provider{
+		Username: fl.String("username"),
+		Password: fl.String("password"),
+		BaseURL:  fl.String("base-url"),
+		DomainID: fl.String("domain-id"),
+		log:      caddy.Log().Named("dns.providers.tarka"),
+	}
+	if p.Username == "" || p.Password == "" {
+		return nil, fmt.Errorf("--username and --password (or TARKA_USERNAME and TARKA_PASSWORD) are required")
+	}
+	return p, nil
+}
+
+func cmdExport(fl caddycmd.Flags) (int, error) {
+	zone := fl.String("zone")
+	if zone == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--zone is required")
+	}
+	p, err := providerFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	zoneFile, err := p.ExportZone(context.Background(), zone)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if output := fl.String("output"); output != "" {
+		if err := os.WriteFile(output, zoneFile, 0o644); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+	if _, err := os.Stdout.Write(zoneFile); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	zone, file := fl.String("zone"), fl.String("file")
+	if zone == "" || file == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--zone and --file are required")
+	}
+	p, err := providerFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	plan, err := p.PlanZoneFile(ctx, zone, f, fl.Bool("keep-existing"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	plan.WriteTo(os.Stdout)
+	if plan.Empty() {
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	if !fl.Bool("yes") && !confirm("Apply these changes?") {
+		fmt.Println("Nothing changed.")
+		return caddy.ExitCodeSuccess, nil
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdRollback(fl caddycmd.Flags) (int, error) {
+	zone := fl.String("zone")
+	if zone == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--zone is required")
+	}
+	p, err := providerFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	c, err := p.getClient()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	p.Snapshots = &SnapshotConfig{Dir: fl.String("dir")}
+	p.storage = caddy.DefaultStorage
+	if err := p.setupSnapshots(c.BaseURL()); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx := context.Background()
+	name := fl.String("snapshot")
+	if name == "" {
+		names, err := p.ListSnapshots(ctx, zone)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if len(names) == 0 {
+			fmt.Printf("No snapshots of %s.\n", zone)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	plan, err := p.PlanRollback(ctx, zone, name)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	plan.WriteTo(os.Stdout)
+	if plan.Empty() {
+		return caddy.ExitCodeSuccess, nil
+	}
+	if !fl.Bool("yes") && !confirm("Apply these changes?") {
+		fmt.Println("Nothing changed.")
+		return caddy.ExitCodeSuccess, nil
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// exitCodeDrift is the status of sync in plan mode when the zone has drifted
+const exitCodeDrift = 2
+
+func cmdSync(fl caddycmd.Flags) (int, error) {
+	file := fl.String("file")
+	if file == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--file is required")
+	}
+	p, err := providerFromFlags(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer f.Close()
+	state, err := ParseDesiredState(f, strings.EqualFold(filepath.Ext(file), ".json"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if owner := fl.String("owner"); owner != "" {
+		if err := validateSyncOwner(owner); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		state.Owner = owner
+	}
+
+	ctx := context.Background()
+	plan, err := p.PlanSync(ctx, state, fl.Bool("prune"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	plan.WriteTo(os.Stdout)
+	if plan.Empty() {
+		return caddy.ExitCodeSuccess, nil
+	}
+	if !fl.Bool("apply") {
+		return exitCodeDrift, nil
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// confirm asks a yes/no question on stdin, defaulting to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,434 @@
+package tarka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(new(DDNS))
+	httpcaddyfile.RegisterGlobalOption("tarka_ddns", parseDDNSOption)
+}
+
+// defaultDDNSInterval is how often the app checks the IP addresses by default
+const defaultDDNSInterval = 10 * time.Minute
+
+// IPSource finds the host's current public IP addresses. Sources are Caddy
+// modules in the tarka_ddns.ip_sources namespace.
+type IPSource interface {
+	GetIPs(ctx context.Context) ([]netip.Addr, error)
+}
+
+// DDNS is a Caddy app that keeps A and AAAA records in Tarka pointing at the
+// host's current public IP addresses. Records are only touched when the
+// addresses change; the addresses last set are kept in Caddy's storage, so a
+// restart doesn't rewrite them either.
+type DDNS struct {
+	// Provider is the Tarka account the records are in
+	Provider *Provider `json:"provider"`
+
+	// Domains maps each zone to the names in it to keep updated, e.g.
+	// {"example.com": ["@", "www"]}
+	Domains map[string][]string `json:"domains"`
+
+	// SourcesRaw are the sources of IP addresses. For each IP version, the
+	// first source returning an address of that version is used (defaults
+	// to the http source with its default endpoints).
+	SourcesRaw []json.RawMessage `json:"ip_sources,omitempty" caddy:"namespace=tarka_ddns.ip_sources inline_key=source"`
+
+	// Versions to keep records for: "ipv4" (A) and "ipv6" (AAAA) (defaults to both)
+	Versions []string `json:"versions,omitempty"`
+
+	// How often to check the IP addresses (defaults to 10m)
+	CheckInterval caddy.Duration `json:"check_interval,omitempty"`
+
+	// TTL of the records (defaults to the provider's default TTL)
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	sources []IPSource
+	storage certmagic.Storage
+	prefix  string
+
+	// state maps "<name>.<zone>/<type>" to the addresses last set there
+	state   map[string][]string
+	stateMu sync.Mutex
+
+	cancel context.CancelFunc
+	log    *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*DDNS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tarka_ddns",
+		New: func() caddy.Module { return new(DDNS) },
+	}
+}
+
+// Provision sets up the provider and IP sources. Implements caddy.Provisioner.
+func (a *DDNS) Provision(ctx caddy.Context) error {
+	a.log = ctx.Logger()
+	if a.Provider == nil {
+		return fmt.Errorf("tarka_ddns needs a provider")
+	}
+	if len(a.Domains) == 0 {
+		return fmt.Errorf("tarka_ddns needs at least one domain")
+	}
+	for _, version := range a.Versions {
+		if version != "ipv4" && version != "ipv6" {
+			return fmt.Errorf("invalid version %q: must be ipv4 or ipv6", version)
+		}
+	}
+	if a.CheckInterval < 0 {
+		return fmt.Errorf("invalid check_interval %v: must not be negative", time.Duration(a.CheckInterval))
+	}
+	if a.CheckInterval == 0 {
+		a.CheckInterval = caddy.Duration(defaultDDNSInterval)
+	}
+	if err := a.Provider.Provision(ctx); err != nil {
+		return fmt.Errorf("provisioning provider: %w", err)
+	}
+
+	if a.SourcesRaw != nil {
+		mods, err := ctx.LoadModule(a, "SourcesRaw")
+		if err != nil {
+			return fmt.Errorf("loading IP sources: %w", err)
+		}
+		for _, mod := range mods.([]any) {
+			a.sources = append(a.sources, mod.(IPSource))
+		}
+	}
+	if len(a.sources) == 0 {
+		a.sources = []IPSource{new(HTTPSource)}
+	}
+
+	c, err := a.Provider.getClient()
+	if err != nil {
+		return err
+	}
+	a.storage = contextStorage(ctx)
+	a.prefix = storagePrefix("ddns", c.BaseURL())
+	return a.loadState(ctx)
+}
+
+// Start begins checking the IP addresses. Implements caddy.App.
+func (a *DDNS) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	go a.run(ctx)
+	return nil
+}
+
+// Stop stops checking the IP addresses. Implements caddy.App.
+func (a *DDNS) Stop() error {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	return nil
+}
+
+// Cleanup releases the provider, which Caddy only cleans up itself when it
+// loads it as a module. Implements caddy.CleanerUpper.
+func (a *DDNS) Cleanup() error {
+	if a.Provider == nil {
+		return nil
+	}
+	return a.Provider.Cleanup()
+}
+
+// run checks the IP addresses straight away and then every interval until
+// ctx is done
+func (a *DDNS) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(a.CheckInterval))
+	defer ticker.Stop()
+	for {
+		a.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check looks up the current IP addresses and updates every record whose
+// addresses differ from those last set, returning how many RRsets it set
+func (a *DDNS) check(ctx context.Context) int {
+	ips := a.currentIPs(ctx)
+
+	set := 0
+	for zone, names := range a.Domains {
+		var (
+			records []libdns.Record
+			pending = make(map[string][]string)
+		)
+		for _, name := range names {
+			for recordType, addrs := range ips {
+				key, err := ddnsStateKey(name, zone, recordType)
+				if err != nil {
+					a.log.Error("invalid domain", zap.String("name", name), zap.String("zone", zone), zap.Error(err))
+					continue
+				}
+				values := addrStrings(addrs)
+				if slices.Equal(a.lastSet(key), values) {
+					continue
+				}
+				for _, addr := range addrs {
+					records = append(records, libdns.Address{Name: name, TTL: time.Duration(a.TTL), IP: addr})
+				}
+				pending[key] = values
+			}
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		a.log.Info("IP addresses changed, updating records", zap.String("zone", zone), zap.Int("rrsets", len(pending)))
+		if _, err := a.Provider.SetRecords(ctx, zone, records); err != nil {
+			a.log.Error("failed to update records", zap.String("zone", zone), zap.Error(err))
+			continue
+		}
+		a.stateMu.Lock()
+		for key, values := range pending {
+			a.state[key] = values
+		}
+		a.stateMu.Unlock()
+		set += len(pending)
+	}
+
+	if set > 0 {
+		if err := a.saveState(ctx); err != nil {
+			a.log.Error("failed to save state", zap.Error(err))
+		}
+	}
+	return set
+}
+
+// currentIPs asks the sources for the host's addresses, returning them by
+// record type. For each IP version, the first source with an address of
+// that version wins; versions no source has an address for are left out.
+func (a *DDNS) currentIPs(ctx context.Context) map[string][]netip.Addr {
+	want := map[string]bool{"A": true, "AAAA": true}
+	if len(a.Versions) > 0 {
+		want = map[string]bool{"A": slices.Contains(a.Versions, "ipv4"), "AAAA": slices.Contains(a.Versions, "ipv6")}
+	}
+
+	ips := make(map[string][]netip.Addr)
+	for _, source := range a.sources {
+		addrs, err := source.GetIPs(ctx)
+		if err != nil {
+			a.log.Warn("IP source failed", zap.String("source", fmt.Sprintf("%T", source)), zap.Error(err))
+		}
+		found := make(map[string][]netip.Addr)
+		for _, addr := range addrs {
+			recordType := "A"
+			if addr.Is6() {
+				recordType = "AAAA"
+			}
+			if want[recordType] && !slices.Contains(found[recordType], addr) {
+				found[recordType] = append(found[recordType], addr)
+			}
+		}
+		for recordType, addrs := range found {
+			if _, ok := ips[recordType]; !ok {
+				slices.SortFunc(addrs, netip.Addr.Compare)
+				ips[recordType] = addrs
+			}
+		}
+		if len(ips) == len(want) {
+			break
+		}
+	}
+	return ips
+}
+
+// ddnsStateKey identifies an RRset in the state
+func ddnsStateKey(name, zone, recordType string) (string, error) {
+	fqdn, err := absoluteName(name, zone)
+	if err != nil {
+		return "", err
+	}
+	return fqdn + "/" + recordType, nil
+}
+
+func addrStrings(addrs []netip.Addr) []string {
+	values := make([]string, len(addrs))
+	for i, addr := range addrs {
+		values[i] = addr.String()
+	}
+	return values
+}
+
+func (a *DDNS) lastSet(key string) []string {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	return a.state[key]
+}
+
+func (a *DDNS) stateKey() string {
+	return path.Join(a.prefix, "state.json")
+}
+
+// loadState reads the addresses last set from storage
+func (a *DDNS) loadState(ctx context.Context) error {
+	a.state = make(map[string][]string)
+	if a.storage == nil {
+		return nil
+	}
+	data, err := a.storage.Load(ctx, a.stateKey())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load ddns state: %w", err)
+	}
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return fmt.Errorf("failed to decode ddns state: %w", err)
+	}
+	return nil
+}
+
+// saveState writes the addresses last set to storage
+func (a *DDNS) saveState(ctx context.Context) error {
+	if a.storage == nil {
+		return nil
+	}
+	a.stateMu.Lock()
+	data, err := json.Marshal(a.state)
+	a.stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return a.storage.Store(ctx, a.stateKey(), data)
+}
+
+// parseDDNSOption parses the tarka_ddns global option:
+//
+//	tarka_ddns {
+//		provider {
+//			username  <user>
+//			password  <pass>
+//			...
+//		}
+//		domains {
+//			<zone> <names...>
+//		}
+//		ip_source interface <name>
+//		ip_source http [<endpoints...>]
+//		ip_source command <command> [<args...>]
+//		versions ipv4|ipv6...
+//		check_interval <duration>
+//		ttl <duration>
+//	}
+func parseDDNSOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := &DDNS{Domains: make(map[string][]string)}
+	d.Next() // consume option name
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "provider":
+			app.Provider = new(Provider)
+			if err := app.Provider.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "domains":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			for domainsNesting := d.Nesting(); d.NextBlock(domainsNesting); {
+				zone := d.Val()
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					names = []string{"@"}
+				}
+				app.Domains[zone] = append(app.Domains[zone], names...)
+			}
+		case "ip_source":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			var (
+				source IPSource
+				name   = d.Val()
+				args   = d.RemainingArgs()
+			)
+			switch name {
+			case "interface":
+				if len(args) != 1 {
+					return nil, d.ArgErr()
+				}
+				source = &InterfaceSource{Name: args[0]}
+			case "http":
+				source = &HTTPSource{Endpoints: args}
+			case "command":
+				if len(args) == 0 {
+					return nil, d.ArgErr()
+				}
+				source = &CommandSource{Command: args[0], Args: args[1:]}
+			default:
+				return nil, d.Errf("unrecognized ip_source '%s'", name)
+			}
+			app.SourcesRaw = append(app.SourcesRaw, caddyconfig.JSONModuleObject(source, "source", name, nil))
+		case "versions":
+			app.Versions = d.RemainingArgs()
+			if len(app.Versions) == 0 {
+				return nil, d.ArgErr()
+			}
+			for _, version := range app.Versions {
+				if version != "ipv4" && version != "ipv6" {
+					return nil, d.Errf("invalid version '%s': must be ipv4 or ipv6", version)
+				}
+			}
+		case "check_interval", "ttl":
+			option := d.Val()
+			var value string
+			if !d.AllArgs(&value) {
+				return nil, d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(value)
+			if err != nil {
+				return nil, d.Errf("invalid duration for %s: %v", option, err)
+			}
+			if option == "check_interval" {
+				app.CheckInterval = caddy.Duration(duration)
+			} else {
+				app.TTL = caddy.Duration(duration)
+			}
+		default:
+			return nil, d.Errf("unrecognized tarka_ddns subdirective '%s'", d.Val())
+		}
+	}
+	if app.Provider == nil {
+		return nil, d.Err("missing 'provider'")
+	}
+
+	return httpcaddyfile.App{
+		Name:  "tarka_ddns",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*DDNS)(nil)
+	_ caddy.Provisioner  = (*DDNS)(nil)
+	_ caddy.CleanerUpper = (*DDNS)(nil)
+)
@@ -0,0 +1,177 @@
+package tarka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(new(InterfaceSource))
+	caddy.RegisterModule(new(HTTPSource))
+	caddy.RegisterModule(new(CommandSource))
+}
+
+// defaultEchoEndpoints answer with the IPv4 and IPv6 address they see the
+// request come from
+var defaultEchoEndpoints = []string{"https://ipv4.icanhazip.com", "https://ipv6.icanhazip.com"}
+
+// httpSourceTimeout bounds each request to an echo endpoint
+const httpSourceTimeout = 10 * time.Second
+
+// InterfaceSource reads the public addresses assigned to a network
+// interface, skipping loopback, link-local and private ones
+type InterfaceSource struct {
+	// Name of the interface, e.g. eth0
+	Name string `json:"name"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*InterfaceSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tarka_ddns.ip_sources.interface",
+		New: func() caddy.Module { return new(InterfaceSource) },
+	}
+}
+
+// GetIPs returns the interface's public addresses
+func (s *InterfaceSource) GetIPs(context.Context) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read addresses of %s: %w", s.Name, err)
+	}
+	var ips []netip.Addr
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if ok && ip.Unmap().IsGlobalUnicast() && !ip.IsPrivate() {
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips, nil
+}
+
+// HTTPSource asks echo endpoints which address requests come from. Each
+// endpoint answers with one address in plain text.
+type HTTPSource struct {
+	// Endpoints to ask (defaults to ipv4.icanhazip.com and ipv6.icanhazip.com)
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HTTPSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tarka_ddns.ip_sources.http",
+		New: func() caddy.Module { return new(HTTPSource) },
+	}
+}
+
+// GetIPs returns the addresses the endpoints answer with. Endpoints that
+// fail are skipped, as on a host without IPv6 the IPv6 endpoint always will;
+// an error is returned only if none answer.
+func (s *HTTPSource) GetIPs(ctx context.Context) ([]netip.Addr, error) {
+	endpoints := s.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = defaultEchoEndpoints
+	}
+	var (
+		ips  []netip.Addr
+		errs []error
+	)
+	for _, endpoint := range endpoints {
+		ip, err := echoIP(ctx, endpoint)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return ips, nil
+}
+
+func echoIP(ctx context.Context, endpoint string) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, httpSourceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s answered with no IP address: %w", endpoint, err)
+	}
+	return ip.Unmap(), nil
+}
+
+// CommandSource runs a command that prints the addresses, separated by
+// whitespace
+type CommandSource struct {
+	// Command to run
+	Command string `json:"command"`
+
+	// Args to pass it
+	Args []string `json:"args,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*CommandSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tarka_ddns.ip_sources.command",
+		New: func() caddy.Module { return new(CommandSource) },
+	}
+}
+
+// GetIPs runs the command and parses its output
+func (s *CommandSource) GetIPs(ctx context.Context) ([]netip.Addr, error) {
+	out, err := exec.CommandContext(ctx, s.Command, s.Args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", s.Command, err)
+	}
+	var ips []netip.Addr
+	for _, field := range strings.Fields(string(out)) {
+		ip, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("%s printed %q, which is not an IP address", s.Command, field)
+		}
+		ips = append(ips, ip.Unmap())
+	}
+	return ips, nil
+}
+
+// Interface guards
+var (
+	_ IPSource = (*InterfaceSource)(nil)
+	_ IPSource = (*HTTPSource)(nil)
+	_ IPSource = (*CommandSource)(nil)
+)
@@ -0,0 +1,197 @@
+package tarka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/nsna/tarka/internal/tarkatest"
+	"go.uber.org/zap"
+)
+
+// staticSource is an IPSource returning fixed addresses
+type staticSource struct{ ips []netip.Addr }
+
+func (s *staticSource) GetIPs(context.Context) ([]netip.Addr, error) { return s.ips, nil }
+
+func TestDDNS_Check(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	id := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	source := &staticSource{ips: []netip.Addr{netip.MustParseAddr("192.0.2.10")}}
+	newApp := func() *DDNS {
+		app := &DDNS{
+			Provider: newTestProvider(server.URL),
+			Domains:  map[string][]string{"example.com": {"www"}},
+			sources:  []IPSource{source},
+			storage:  storage,
+			prefix:   storagePrefix("ddns", server.BaseURL()),
+			log:      zap.NewNop(),
+		}
+		if err := app.loadState(context.Background()); err != nil {
+			t.Fatalf("loadState failed: %v", err)
+		}
+		return app
+	}
+	ctx := context.Background()
+
+	app := newApp()
+	if n := app.check(ctx); n != 1 {
+		t.Fatalf("expected 1 RRset set, got %d", n)
+	}
+	records := server.Records("123")
+	if len(records) != 1 || records[0].Data != "192.0.2.10" || records[0].ID != id {
+		t.Fatalf("expected the record to be edited in place, got %+v", records)
+	}
+
+	// Unchanged addresses don't touch Tarka, even after a restart
+	edits := server.Requests("/custdata/domain-rr-edit.php")
+	if n := app.check(ctx); n != 0 {
+		t.Errorf("expected nothing set when the address is unchanged, got %d", n)
+	}
+	if n := newApp().check(ctx); n != 0 {
+		t.Errorf("expected the state to survive a restart, got %d set", n)
+	}
+	if n := server.Requests("/custdata/domain-rr-edit.php"); n != edits {
+		t.Errorf("expected no edits, got %d", n-edits)
+	}
+
+	// A new address is picked up; with no IPv6 address, AAAA records are left alone
+	source.ips = []netip.Addr{netip.MustParseAddr("192.0.2.20")}
+	if n := app.check(ctx); n != 1 {
+		t.Fatalf("expected 1 RRset set, got %d", n)
+	}
+	records = server.Records("123")
+	if len(records) != 1 || records[0].Data != "192.0.2.20" {
+		t.Errorf("expected the new address, got %+v", records)
+	}
+}
+
+func TestDDNS_CurrentIPs(t *testing.T) {
+	app := &DDNS{
+		sources: []IPSource{
+			&staticSource{ips: []netip.Addr{netip.MustParseAddr("192.0.2.1")}},
+			&staticSource{ips: []netip.Addr{netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("2001:db8::1")}},
+		},
+		log: zap.NewNop(),
+	}
+	ips := app.currentIPs(context.Background())
+	want := map[string][]netip.Addr{
+		"A":    {netip.MustParseAddr("192.0.2.1")},
+		"AAAA": {netip.MustParseAddr("2001:db8::1")},
+	}
+	if !reflect.DeepEqual(ips, want) {
+		t.Errorf("expected %v, got %v", want, ips)
+	}
+
+	app.Versions = []string{"ipv6"}
+	if ips := app.currentIPs(context.Background()); len(ips) != 1 || len(ips["AAAA"]) != 1 {
+		t.Errorf("expected only the IPv6 address, got %v", ips)
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("198.51.100.7\n"))
+	}))
+	defer echo.Close()
+
+	source := &HTTPSource{Endpoints: []string{echo.URL + "/broken", echo.URL}}
+	ips, err := source.GetIPs(context.Background())
+	if err != nil {
+		t.Fatalf("GetIPs failed: %v", err)
+	}
+	if len(ips) != 1 || ips[0] != netip.MustParseAddr("198.51.100.7") {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+
+	source.Endpoints = source.Endpoints[:1]
+	if _, err := source.GetIPs(context.Background()); err == nil {
+		t.Error("expected an error when no endpoint answers")
+	}
+}
+
+func TestCommandSource(t *testing.T) {
+	source := &CommandSource{Command: "echo", Args: []string{"192.0.2.5", "2001:db8::5"}}
+	ips, err := source.GetIPs(context.Background())
+	if err != nil {
+		t.Fatalf("GetIPs failed: %v", err)
+	}
+	if len(ips) != 2 || !ips[1].Is6() {
+		t.Errorf("unexpected addresses %v", ips)
+	}
+
+	source.Args = []string{"not-an-ip"}
+	if _, err := source.GetIPs(context.Background()); err == nil {
+		t.Error("expected an error for output that isn't an address")
+	}
+}
+
+func TestParseDDNSOption(t *testing.T) {
+	input := `tarka_ddns {
+		provider {
+			username  testuser
+			password  testpass
+			domain_id 123
+		}
+		domains {
+			example.com @ www
+		}
+		ip_source interface eth0
+		ip_source http https://ipv4.example.net
+		versions ipv4
+		check_interval 5m
+		ttl 2m
+	}`
+
+	val, err := parseDDNSOption(caddyfile.NewTestDispenser(input), nil)
+	if err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	app := val.(httpcaddyfile.App)
+	if app.Name != "tarka_ddns" {
+		t.Errorf("expected app tarka_ddns, got %s", app.Name)
+	}
+	var cfg struct {
+		Provider      *Provider           `json:"provider"`
+		Domains       map[string][]string `json:"domains"`
+		Sources       []map[string]any    `json:"ip_sources"`
+		Versions      []string            `json:"versions"`
+		CheckInterval int64               `json:"check_interval"`
+	}
+	if err := json.Unmarshal(app.Value, &cfg); err != nil {
+		t.Fatalf("failed to decode app config: %v", err)
+	}
+	if cfg.Provider.Username != "testuser" || cfg.Provider.DomainID != "123" {
+		t.Errorf("unexpected provider %s/%s", cfg.Provider.Username, cfg.Provider.DomainID)
+	}
+	if !reflect.DeepEqual(cfg.Domains, map[string][]string{"example.com": {"@", "www"}}) {
+		t.Errorf("unexpected domains %v", cfg.Domains)
+	}
+	if len(cfg.Sources) != 2 || cfg.Sources[0]["source"] != "interface" || cfg.Sources[0]["name"] != "eth0" || cfg.Sources[1]["source"] != "http" {
+		t.Errorf("unexpected sources %v", cfg.Sources)
+	}
+	if len(cfg.Versions) != 1 || cfg.CheckInterval != 5*60*1e9 {
+		t.Errorf("unexpected versions %v or interval %d", cfg.Versions, cfg.CheckInterval)
+	}
+
+	if _, err := parseDDNSOption(caddyfile.NewTestDispenser(`tarka_ddns {
+		ip_source ftp
+	}`), nil); err == nil {
+		t.Error("expected an error for an unknown source")
+	}
+}
@@ -0,0 +1,303 @@
+package tarka
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+// maxCNAMEHops bounds how long a CNAME chain FollowCNAMEs follows
+const maxCNAMEHops = 8
+
+// Delegation sends the TXT records of one name to a name in a Tarka zone,
+// for domains hosted elsewhere that CNAME their ACME challenge name to Tarka:
+//
+//	_acme-challenge.example.net. CNAME example-net.acme.example.com.
+type Delegation struct {
+	// Name delegated, e.g. _acme-challenge.example.net
+	Name string `json:"name"`
+
+	// Target the name is a CNAME to, e.g. example-net.acme.example.com
+	Target string `json:"target"`
+
+	// Zone in Tarka holding the target (defaults to the account's domain
+	// the target is under)
+	Zone string `json:"zone,omitempty"`
+
+	// DomainID of Zone (defaults to looking it up by name)
+	DomainID string `json:"domain_id,omitempty"`
+}
+
+// CNAMEFollowing makes the provider look up CNAMEs of the names it is given
+// TXT records for, and write the records to where the CNAME chain ends
+type CNAMEFollowing struct {
+	// Resolvers to query, as host:port (defaults to those in /etc/resolv.conf)
+	Resolvers []string `json:"resolvers,omitempty"`
+}
+
+// zoneTarget is a Tarka zone records are written to
+type zoneTarget struct {
+	zone, domainID string
+}
+
+// forEachZone calls fn with the records for zone, and once for each zone
+// that TXT records are delegated to, with names relative to that zone. As
+// delegated names no longer say what they are for, fn is also given the
+// certificates delegated ACME challenge records validate, by their name in
+// the target zone. The records fn returns are named relative to zone again,
+// so callers can pass them back to DeleteRecords for the same zone.
+func (p *Provider) forEachZone(ctx context.Context, zone string, records []libdns.Record,
+	fn func(ctx context.Context, c *client.Client, zone, domainID string, records []libdns.Record, certificates map[string]string) ([]libdns.Record, error)) ([]libdns.Record, error) {
+	if len(p.Delegations) == 0 && p.FollowCNAMEs == nil {
+		c, domainID, err := p.zoneClient(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		return fn(ctx, c, zone, domainID, records, nil)
+	}
+
+	c, err := p.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		local     []libdns.Record
+		targets   []zoneTarget
+		delegated = make(map[zoneTarget][]libdns.Record)
+		// original names of delegated records, by target zone and name there
+		original = make(map[zoneTarget]map[string]string)
+		// certificates of delegated challenge records, likewise
+		certificates = make(map[zoneTarget]map[string]string)
+	)
+	for _, record := range records {
+		rr := record.RR()
+		if rr.Type != "TXT" {
+			local = append(local, record)
+			continue
+		}
+		target, name, ok, err := p.delegationFor(ctx, c, rr.Name, zone)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			local = append(local, record)
+			continue
+		}
+		p.log.Debug("Delegating record", zap.String("name", rr.Name), zap.String("zone", zone),
+			zap.String("target", name), zap.String("target_zone", target.zone), zap.String("domain_id", target.domainID))
+		if _, ok := delegated[target]; !ok {
+			targets = append(targets, target)
+			original[target] = make(map[string]string)
+			certificates[target] = make(map[string]string)
+		}
+		delegated[target] = append(delegated[target], renamed(record, name))
+		original[target][libdnsName(name, target.zone)] = rr.Name
+		if relative, err := tarkaName(rr.Name, zone); err == nil {
+			if certificate := challengeCertificate(relative, zone); certificate != "" {
+				certificates[target][name] = certificate
+			}
+		}
+	}
+
+	var results []libdns.Record
+	if len(local) > 0 {
+		domainID, err := p.resolveDomainID(ctx, c, zone)
+		if err != nil {
+			return nil, err
+		}
+		changed, err := fn(ctx, c, zone, domainID, local, nil)
+		results = append(results, changed...)
+		if err != nil {
+			return results, err
+		}
+	}
+	for _, target := range targets {
+		changed, err := fn(ctx, c, target.zone, target.domainID, delegated[target], certificates[target])
+		for _, record := range changed {
+			if name, ok := original[target][libdnsName(record.RR().Name, target.zone)]; ok {
+				record = renamed(record, name)
+			}
+			results = append(results, record)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// delegationFor returns the Tarka zone and the name relative to it that a
+// TXT record for name in zone is written to, if it is delegated
+func (p *Provider) delegationFor(ctx context.Context, c *client.Client, name, zone string) (zoneTarget, string, bool, error) {
+	fqdn, err := absoluteName(name, zone)
+	if err != nil {
+		return zoneTarget{}, "", false, err
+	}
+
+	for _, d := range p.Delegations {
+		from, err := normalizeZone(d.Name)
+		if err != nil || from != fqdn {
+			continue
+		}
+		target, err := normalizeZone(d.Target)
+		if err != nil {
+			return zoneTarget{}, "", false, fmt.Errorf("invalid delegation target: %w", err)
+		}
+		if d.Zone == "" {
+			return p.targetZone(ctx, c, target)
+		}
+		dt := zoneTarget{zone: d.Zone, domainID: d.DomainID}
+		if dt.domainID == "" {
+			if dt.domainID, err = p.lookupDomainID(ctx, c, d.Zone); err != nil {
+				return zoneTarget{}, "", false, err
+			}
+		}
+		relative, err := tarkaName(target, d.Zone)
+		if err != nil {
+			return zoneTarget{}, "", false, fmt.Errorf("delegation target %s: %w", d.Target, err)
+		}
+		return dt, relative, true, nil
+	}
+
+	if p.FollowCNAMEs == nil {
+		return zoneTarget{}, "", false, nil
+	}
+	target, err := p.followCNAMEs(ctx, fqdn)
+	if err != nil {
+		return zoneTarget{}, "", false, err
+	}
+	if target == fqdn {
+		return zoneTarget{}, "", false, nil
+	}
+	dt, relative, ok, err := p.targetZone(ctx, c, target)
+	if err == nil && !ok {
+		err = fmt.Errorf("%s is a CNAME to %s, which is not in a zone of the Tarka account", fqdn, target)
+	}
+	return dt, relative, ok, err
+}
+
+// targetZone finds the account's domain a name is under, the most specific
+// one if several match
+func (p *Provider) targetZone(ctx context.Context, c *client.Client, name string) (zoneTarget, string, bool, error) {
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return zoneTarget{}, "", false, err
+	}
+	var best zoneTarget
+	for _, domain := range domains {
+		zone, err := normalizeZone(domain.Name)
+		if err != nil || len(zone) <= len(best.zone) {
+			continue
+		}
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			best = zoneTarget{zone: zone, domainID: domain.ID}
+		}
+	}
+	if best.zone == "" {
+		return zoneTarget{}, "", false, nil
+	}
+	relative, err := tarkaName(name, best.zone)
+	if err != nil {
+		return zoneTarget{}, "", false, err
+	}
+	return best, relative, true, nil
+}
+
+// followCNAMEs returns the name a CNAME chain starting at name ends at, or
+// name itself if it has no CNAME
+func (p *Provider) followCNAMEs(ctx context.Context, name string) (string, error) {
+	resolvers := p.FollowCNAMEs.Resolvers
+	if len(resolvers) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return "", fmt.Errorf("no resolvers to follow CNAMEs with: %w", err)
+		}
+		for _, server := range conf.Servers {
+			resolvers = append(resolvers, net.JoinHostPort(server, conf.Port))
+		}
+	}
+
+	current := name
+	for range maxCNAMEHops {
+		target, err := lookupCNAME(ctx, current, resolvers)
+		if err != nil {
+			return "", err
+		}
+		if target == "" {
+			return current, nil
+		}
+		current = target
+	}
+	return "", fmt.Errorf("CNAME chain from %s is longer than %d names", name, maxCNAMEHops)
+}
+
+// lookupCNAME returns the target of name's CNAME, without the trailing dot,
+// or "" if it has none, asking each resolver in turn until one answers
+func lookupCNAME(ctx context.Context, name string, resolvers []string) (string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeCNAME)
+	var lastErr error
+	for _, resolver := range resolvers {
+		resp, _, err := new(dns.Client).ExchangeContext(ctx, msg, resolver)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", resolver, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		for _, answer := range resp.Answer {
+			if cname, ok := answer.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, dns.Fqdn(name)) {
+				return strings.ToLower(strings.TrimSuffix(cname.Target, ".")), nil
+			}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("failed to look up CNAME of %s: %w", name, lastErr)
+}
+
+// withDefaultPort adds port to an address that has none
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// absoluteName returns the fully qualified form of a record name in zone,
+// in lowercase ASCII without the trailing dot
+func absoluteName(name, zone string) (string, error) {
+	relative, err := tarkaName(name, zone)
+	if err != nil {
+		return "", err
+	}
+	zone, err = normalizeZone(zone)
+	if err != nil {
+		return "", err
+	}
+	if relative == "" {
+		return zone, nil
+	}
+	return relative + "." + zone, nil
+}
+
+// renamed returns record with a different name, keeping its ProviderData
+func renamed(record libdns.Record, name string) libdns.Record {
+	rr := record.RR()
+	rr.Name = name
+	parsed, err := rr.Parse()
+	if err != nil {
+		return rr
+	}
+	if data, ok := providerDataOf(record); ok {
+		return withProviderData(parsed, data)
+	}
+	return parsed
+}
@@ -0,0 +1,146 @@
+package tarka
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestProvider_Delegation(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("200", "acme.example.com")
+
+	p := newTestProvider(server.URL)
+	p.DomainID = ""
+	p.DeleteUnowned = true
+	p.Delegations = []Delegation{{Name: "_acme-challenge.example.net", Target: "example-net.acme.example.com"}}
+	ctx := context.Background()
+
+	appended, err := p.AppendRecords(ctx, "example.net.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	records := server.Records("200")
+	if len(records) != 1 || records[0].Name != "example-net" || records[0].Type != "TXT" {
+		t.Fatalf("expected the TXT record at example-net in the delegated zone, got %+v", records)
+	}
+	if len(appended) != 1 || appended[0].RR().Name != "_acme-challenge" {
+		t.Fatalf("expected the record named as requested, got %+v", appended)
+	}
+	if data, _ := providerDataOf(appended[0]); data.DomainID != "200" {
+		t.Errorf("expected the record to carry the delegated domain ID, got %+v", data)
+	}
+
+	deleted, err := p.DeleteRecords(ctx, "example.net.", appended)
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("expected 1 record deleted, got %d, err %v", len(deleted), err)
+	}
+	if len(server.Records("200")) != 0 {
+		t.Error("expected the delegated record to be deleted")
+	}
+}
+
+func TestProvider_Delegation_ChallengeExpiry(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("200", "acme.example.com")
+
+	p := newTestProvider(server.URL)
+	p.DomainID = ""
+	p.Delegations = []Delegation{{Name: "_acme-challenge.example.net", Target: "example-net.acme.example.com"}}
+	ctx := context.Background()
+
+	appended, err := p.AppendRecords(ctx, "example.net.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if data, _ := providerDataOf(appended[0]); data.Expires.IsZero() {
+		t.Errorf("expected the delegated challenge record to expire, got %+v", data)
+	}
+	entries := p.ledger.list()
+	if len(entries) != 1 || entries[0].Certificate != "example.net" {
+		t.Fatalf("expected a ledger entry for the example.net challenge, got %+v", entries)
+	}
+
+	// The sweeper removes it once stale, though it isn't named _acme-challenge
+	entry := entries[0]
+	entry.Created = time.Now().Add(-2 * time.Hour)
+	p.ledger.add(ctx, entry)
+	if removed := p.sweep(ctx); removed != 1 {
+		t.Fatalf("expected the delegated record to be swept, got %d", removed)
+	}
+	if len(server.Records("200")) != 0 {
+		t.Error("expected the delegated record to be deleted")
+	}
+}
+
+func TestProvider_FollowCNAMEs(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("200", "acme.example.com")
+	server.AddDomain("300", "example.com")
+
+	resolver := cnameServer(t, map[string]string{
+		"_acme-challenge.example.org.":               "_acme-challenge.example.org.alias.example.",
+		"_acme-challenge.example.org.alias.example.": "example-org.acme.example.com.",
+		"_acme-challenge.example.biz.":               "elsewhere.example.",
+	})
+
+	p := newTestProvider(server.URL)
+	p.DomainID = ""
+	p.FollowCNAMEs = &CNAMEFollowing{Resolvers: []string{resolver}}
+	ctx := context.Background()
+
+	if _, err := p.AppendRecords(ctx, "example.org.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}}); err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	records := server.Records("200")
+	if len(records) != 1 || records[0].Name != "example-org" {
+		t.Fatalf("expected the record at the end of the CNAME chain, got %+v", records)
+	}
+
+	// Names without a CNAME are written to their own zone
+	if _, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}}); err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if len(server.Records("300")) != 1 {
+		t.Errorf("expected the record in its own zone, got %+v", server.Records("300"))
+	}
+
+	// A CNAME leading out of the account can't be written to
+	if _, err := p.AppendRecords(ctx, "example.biz.", []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}}); err == nil {
+		t.Error("expected an error for a CNAME to a name outside the account")
+	}
+}
+
+// cnameServer starts a DNS server answering CNAME queries from cnames,
+// returning its address
+func cnameServer(t *testing.T, cnames map[string]string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if target, ok := cnames[req.Question[0].Name]; ok {
+			resp.Answer = append(resp.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+		} else {
+			resp.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,106 @@
+package tarka
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nsna/tarka/client"
+)
+
+// ExportZone returns the records of a zone as an RFC 1035 zone file, with
+// names relative to an $ORIGIN of the zone and a $TTL of Tarka's default.
+// Tarka manages the SOA itself and doesn't list it, so the file has none.
+func (p *Provider) ExportZone(ctx context.Context, zone string) (_ []byte, err error) {
+	ctx, span := p.startSpan(ctx, "ExportZone", zone, nil)
+	defer func() { endSpan(span, err) }()
+
+	c, domainID, err := p.zoneClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	listed, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; Tarka domain %s, exported %s\n", domainID, time.Now().UTC().Format(time.RFC3339))
+	if err := writeZoneFile(&buf, zone, listed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeZoneFile writes records in zone file form, sorted by name and type.
+// Records of types Tarka doesn't support are noted in comments.
+func writeZoneFile(w io.Writer, zone string, records []client.Record) error {
+	origin, err := normalizeZone(zone)
+	if err != nil {
+		return err
+	}
+	records = append([]client.Record(nil), records...)
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Type < records[j].Type
+	})
+
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s.\n$TTL %d\n", origin, client.DefaultTTL); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		name := libdnsName(rec.Name, zone)
+		data, err := zoneFileData(rec)
+		if err != nil {
+			_, err = fmt.Fprintf(w, "; skipped %s %s: %v\n", name, rec.Type, err)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\t%d\tIN\t%s\t%s\n", name, rec.TTL, rec.Type, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneFileData converts record data from the form the web UI shows to zone
+// file presentation form. Tarka takes host names without the trailing dot,
+// so target names are made fully qualified.
+func zoneFileData(rec client.Record) (string, error) {
+	if !client.IsSupportedType(rec.Type) {
+		return "", fmt.Errorf("unsupported record type")
+	}
+	switch rec.Type {
+	case "TXT":
+		text, err := client.DecodeTXT(rec.Data)
+		if err != nil {
+			return "", err
+		}
+		return client.QuoteTXT(text), nil
+	case "CNAME", "NS", "PTR":
+		return fqdn(rec.Data), nil
+	case "MX", "SRV":
+		// The target is the last field: "10 mail.example.com" or "10 5 443 host.example.com"
+		fields := strings.Fields(rec.Data)
+		if want := map[string]int{"MX": 2, "SRV": 4}[rec.Type]; len(fields) != want {
+			return "", fmt.Errorf("malformed %s data %q", rec.Type, rec.Data)
+		}
+		fields[len(fields)-1] = fqdn(fields[len(fields)-1])
+		return strings.Join(fields, " "), nil
+	}
+	return rec.Data, nil
+}
+
+// fqdn returns a host name with a trailing dot
+func fqdn(name string) string {
+	if name == "." || strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,54 @@
+package tarka
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestProvider_ExportZone(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	for _, rec := range []tarkatest.Record{
+		{Name: "", Type: "MX", TTL: 3600, Data: "10 mail.example.com"},
+		{Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"},
+		{Name: "www", Type: "AAAA", TTL: 300, Data: "2001:db8::1"},
+		{Name: "blog", Type: "CNAME", TTL: 3600, Data: "www.example.com"},
+		{Name: "_sip._tcp", Type: "SRV", TTL: 3600, Data: "10 5 5060 sip.example.com"},
+		{Name: "", Type: "TXT", TTL: 3600, Data: `say "hi"`},
+		{Name: "", Type: "CAA", TTL: 3600, Data: `0 issue "letsencrypt.org"`},
+	} {
+		rec.DomainID = "123"
+		server.AddRecord(rec)
+	}
+
+	p := newTestProvider(server.URL)
+	zoneFile, err := p.ExportZone(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatalf("ExportZone failed: %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(zoneFile), "\n") {
+		if line != "" && !strings.HasPrefix(line, ";") {
+			lines = append(lines, line)
+		}
+	}
+	want := []string{
+		"$ORIGIN example.com.",
+		"$TTL 3600",
+		"@\t3600\tIN\tCAA\t0 issue \"letsencrypt.org\"",
+		"@\t3600\tIN\tMX\t10 mail.example.com.",
+		"@\t3600\tIN\tTXT\t\"say \\\"hi\\\"\"",
+		"_sip._tcp\t3600\tIN\tSRV\t10 5 5060 sip.example.com.",
+		"blog\t3600\tIN\tCNAME\twww.example.com.",
+		"www\t300\tIN\tA\t192.0.2.1",
+		"www\t300\tIN\tAAAA\t2001:db8::1",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected zone file:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,132 @@
+package tarka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nsna/tarka/client"
+)
+
+// PlanZoneFile parses an RFC 1035 zone file and plans the changes that make
+// the zone in Tarka match it. Records of types Tarka doesn't support are
+// listed in the plan's Unsupported field rather than failing the import; the
+// SOA is ignored, as Tarka manages it. With keepExisting set, RRsets that
+// aren't in the file are left alone instead of being deleted.
+func (p *Provider) PlanZoneFile(ctx context.Context, zone string, r io.Reader, keepExisting bool) (_ *Plan, err error) {
+	ctx, span := p.startSpan(ctx, "PlanZoneFile", zone, nil)
+	defer func() { endSpan(span, err) }()
+
+	desired, unsupported, err := parseZoneFile(r, zone)
+	if err != nil {
+		return nil, err
+	}
+	for i := range desired {
+		if desired[i].TTL, err = p.effectiveTTL(time.Duration(desired[i].TTL) * time.Second); err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", desired[i].Name, err)
+		}
+	}
+
+	c, domainID, err := p.zoneClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Plan{
+		Zone:        zone,
+		DomainID:    domainID,
+		Changes:     diffRecords(existing, desired, !keepExisting),
+		Unsupported: unsupported,
+	}, nil
+}
+
+// parseZoneFile reads the records of a zone file in the form Tarka takes,
+// returning the records of unsupported types separately, in zone file form
+func parseZoneFile(r io.Reader, zone string) ([]client.Record, []string, error) {
+	origin, err := normalizeZone(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		records     []client.Record
+		unsupported []string
+	)
+	zp := dns.NewZoneParser(r, origin+".", "")
+	zp.SetDefaultTTL(client.DefaultTTL)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		recordType := dns.TypeToString[hdr.Rrtype]
+		if recordType == "SOA" {
+			continue
+		}
+		if !client.IsSupportedType(recordType) {
+			unsupported = append(unsupported, rr.String())
+			continue
+		}
+		name, err := tarkaName(hdr.Name, zone)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := tarkaData(rr)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, client.Record{
+			Name: name,
+			Type: recordType,
+			TTL:  int(hdr.Ttl),
+			Data: data,
+		})
+	}
+	if err := zp.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	return records, unsupported, nil
+}
+
+// tarkaData converts the data of a parsed record to the form the web UI
+// takes: host names without the trailing dot, and TXT text as EncodeTXT
+// writes it
+func tarkaData(rr dns.RR) (string, error) {
+	switch rr := rr.(type) {
+	case *dns.TXT:
+		text, err := txtText(rr)
+		if err != nil {
+			return "", err
+		}
+		return client.EncodeTXT(text), nil
+	case *dns.CNAME:
+		return strings.TrimSuffix(rr.Target, "."), nil
+	case *dns.NS:
+		return strings.TrimSuffix(rr.Ns, "."), nil
+	case *dns.PTR:
+		return strings.TrimSuffix(rr.Ptr, "."), nil
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", rr.Preference, strings.TrimSuffix(rr.Mx, ".")), nil
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", rr.Priority, rr.Weight, rr.Port, strings.TrimSuffix(rr.Target, ".")), nil
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String()), nil
+}
+
+// txtText returns the text of a TXT record. miekg/dns keeps its character
+// strings escaped as in zone files, so they are unescaped before joining.
+func txtText(rr *dns.TXT) (string, error) {
+	var sb strings.Builder
+	for _, s := range rr.Txt {
+		text, err := client.UnescapeTXT(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid TXT record %s: %w", rr.Hdr.Name, err)
+		}
+		sb.WriteString(text)
+	}
+	return sb.String(), nil
+}
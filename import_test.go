@@ -0,0 +1,122 @@
+package tarka
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+const testZoneFile = `$ORIGIN example.com.
+$TTL 3600
+@	IN	SOA	ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600
+@	IN	MX	10 mail
+www	300	IN	A	192.0.2.10
+blog	IN	CNAME	www.example.com.
+@	IN	TXT	"v=spf1 -all"
+@	IN	SSHFP	1 1 123456789abcdef67890123456789abcdef67890
+`
+
+func TestProvider_PlanZoneFile(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "blog", Type: "CNAME", TTL: 3600, Data: "www.example.com"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "old", Type: "A", TTL: 3600, Data: "192.0.2.99"})
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+
+	plan, err := p.PlanZoneFile(ctx, "example.com.", strings.NewReader(testZoneFile), false)
+	if err != nil {
+		t.Fatalf("PlanZoneFile failed: %v", err)
+	}
+	if plan.Count(ActionAdd) != 2 || plan.Count(ActionUpdate) != 1 || plan.Count(ActionDelete) != 1 {
+		var buf bytes.Buffer
+		plan.WriteTo(&buf)
+		t.Fatalf("expected 2 adds, 1 update and 1 delete, got:\n%s", buf.String())
+	}
+	if len(plan.Unsupported) != 1 || !strings.Contains(plan.Unsupported[0], "SSHFP") {
+		t.Errorf("expected the SSHFP record to be reported as unsupported, got %v", plan.Unsupported)
+	}
+
+	var buf bytes.Buffer
+	plan.WriteTo(&buf)
+	for _, want := range []string{"! example.com.", "+ @ 3600 MX 10 mail.example.com", "~ www 300 A 192.0.2.1 -> 300 192.0.2.10", "- old 3600 A 192.0.2.99"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the plan to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+
+	// Keeping existing records leaves the old name alone
+	kept, err := p.PlanZoneFile(ctx, "example.com.", strings.NewReader(testZoneFile), true)
+	if err != nil {
+		t.Fatalf("PlanZoneFile failed: %v", err)
+	}
+	if kept.Count(ActionDelete) != 0 {
+		t.Errorf("expected no deletes when keeping existing records, got %d", kept.Count(ActionDelete))
+	}
+
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+	again, err := p.PlanZoneFile(ctx, "example.com.", strings.NewReader(testZoneFile), false)
+	if err != nil {
+		t.Fatalf("PlanZoneFile failed: %v", err)
+	}
+	if !again.Empty() {
+		buf.Reset()
+		again.WriteTo(&buf)
+		t.Errorf("expected the zone to match the file after applying, got:\n%s", buf.String())
+	}
+}
+
+func TestProvider_ImportTXTEscapes(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+
+	zoneFile := `quoted	3600	IN	TXT	"say \"hi\" \\ ok" "\065"` + "\n"
+	plan, err := p.PlanZoneFile(ctx, "example.com.", strings.NewReader(zoneFile), false)
+	if err != nil {
+		t.Fatalf("PlanZoneFile failed: %v", err)
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+	stored := server.Records("123")
+	if want := `"say \"hi\" \\ okA"`; len(stored) != 1 || stored[0].Data != want {
+		t.Errorf("expected TXT data %s, got %+v", want, stored)
+	}
+}
+
+func TestProvider_PlanZoneFile_KeepsExpiry(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "temp", Type: "A", TTL: 3600, Data: "192.0.2.1", Expires: expires})
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+
+	// Only the TTL changes
+	plan, err := p.PlanZoneFile(ctx, "example.com.", strings.NewReader("temp 300 IN A 192.0.2.1\n"), false)
+	if err != nil {
+		t.Fatalf("PlanZoneFile failed: %v", err)
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+	stored := server.Records("123")
+	if len(stored) != 1 || stored[0].TTL != 300 || stored[0].Expires.Sub(expires).Abs() > time.Minute {
+		t.Errorf("expected the TTL to change and the expiry near %v to be kept, got %+v", expires, stored)
+	}
+}
@@ -0,0 +1,345 @@
+// Package tarkatest provides an in-memory fake of the Tarka DNS web UI for
+// tests. It implements the pages and forms the client package uses: login,
+// the customer view, the record listing and the record edit form.
+package tarkatest
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Username and Password are the credentials the fake accepts
+	Username = "testuser"
+	Password = "testpass"
+
+	authCookieName = "tarka_netcraft_com_au-auth-cookie-2"
+	expiresLayout  = "2006-01-02 15:04:05"
+)
+
+// rrTypes maps the web UI's rr_type_id values to record types
+var rrTypes = map[string]string{
+	"1": "A",
+	"2": "AAAA",
+	"3": "CNAME",
+	"4": "MX",
+	"5": "NS",
+	"6": "PTR",
+	"7": "SRV",
+	"8": "TXT",
+	"9": "CAA",
+}
+
+// Record is a record held by the fake server
+type Record struct {
+	ID       int
+	DomainID string
+	Name     string
+	Type     string
+	TTL      int
+	Data     string
+	Expires  time.Time
+}
+
+// Server is a fake Tarka instance backed by httptest.Server
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	domains  map[string]string // domain ID -> zone name
+	records  map[int]*Record
+	nextID   int
+	sessions map[string]bool
+	logins   int
+	requests map[string]int // path -> count
+	qualify  bool           // list names fully qualified
+}
+
+// NewServer starts a fake Tarka server. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		domains:  make(map[string]string),
+		records:  make(map[int]*Record),
+		nextID:   1000,
+		sessions: make(map[string]bool),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/custdata/login.php", s.handleLogin)
+	mux.HandleFunc("/custdata/customer-view.php", s.requireSession(s.handleCustomerView))
+	mux.HandleFunc("/custdata/domain-view.php", s.requireSession(s.handleDomainView))
+	mux.HandleFunc("/custdata/domain-rr-edit.php", s.requireSession(s.handleEdit))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+// BaseURL returns the base URL to configure clients with
+func (s *Server) BaseURL() string {
+	return s.URL + "/custdata"
+}
+
+// AddDomain adds a zone to the account under the given domain ID
+func (s *Server) AddDomain(id, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domains[id] = name
+}
+
+// QualifyNames makes listings show names fully qualified, with the zone name
+// for the apex, as some Tarka versions do
+func (s *Server) QualifyNames() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.qualify = true
+}
+
+// AddRecord seeds a record, returning its ID
+func (s *Server) AddRecord(rec Record) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(rec)
+}
+
+// Records returns the records of a domain, ordered by ID
+func (s *Server) Records(domainID string) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domainRecords(domainID)
+}
+
+// Requests returns how many requests were made for a path, e.g. "/custdata/login.php"
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// ExpireSessions logs out every client, as if their sessions timed out
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]bool)
+}
+
+func (s *Server) insert(rec Record) int {
+	s.nextID++
+	rec.ID = s.nextID
+	s.records[rec.ID] = &rec
+	return rec.ID
+}
+
+func (s *Server) domainRecords(domainID string) []Record {
+	var records []Record
+	for _, rec := range s.records {
+		if rec.DomainID == domainID {
+			records = append(records, *rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+func (s *Server) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(authCookieName)
+		s.mu.Lock()
+		ok := err == nil && s.sessions[cookie.Value]
+		s.mu.Unlock()
+		if !ok {
+			http.Redirect(w, r, "/custdata/login.php", http.StatusFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		fmt.Fprintln(w, `<html><body><form method="post">Login Page</form></body></html>`)
+		return
+	}
+	if r.FormValue("username") != Username || r.FormValue("password") != Password {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "Login failed")
+		return
+	}
+
+	s.mu.Lock()
+	s.logins++
+	token := "session-" + strconv.Itoa(s.logins)
+	s.sessions[token] = true
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: authCookieName, Value: token, Path: "/"})
+	http.Redirect(w, r, "/custdata/customer-view.php", http.StatusSeeOther)
+}
+
+func (s *Server) handleCustomerView(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.domains))
+	for id := range s.domains {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fmt.Fprintln(w, "<html><body><h1>Your domains</h1><ul>")
+	for _, id := range ids {
+		fmt.Fprintf(w, `<li><a href="domain-view.php?domain_id=%s">%s</a></li>`+"\n", id, html.EscapeString(s.domains[id]))
+	}
+	fmt.Fprintln(w, "</ul></body></html>")
+}
+
+func (s *Server) handleDomainView(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domainID := r.URL.Query().Get("domain_id")
+	if _, ok := s.domains[domainID]; !ok {
+		http.Error(w, "No such domain", http.StatusNotFound)
+		return
+	}
+	s.renderDomain(w, domainID)
+}
+
+// renderDomain writes the record listing of a domain. Callers hold s.mu.
+func (s *Server) renderDomain(w http.ResponseWriter, domainID string) {
+	fmt.Fprintf(w, "<html><body><h1>%s</h1>\n", html.EscapeString(s.domains[domainID]))
+	fmt.Fprintln(w, "<table><tr><th>Name</th><th>Type</th><th>TTL</th><th>Data</th><th>Expires</th><th></th></tr>")
+	for _, rec := range s.domainRecords(domainID) {
+		name := rec.Name
+		switch {
+		case s.qualify && name == "":
+			name = s.domains[domainID] + "."
+		case s.qualify:
+			name += "." + s.domains[domainID] + "."
+		case name == "":
+			name = "@"
+		}
+		ttl := ""
+		if rec.TTL > 0 {
+			ttl = strconv.Itoa(rec.TTL)
+		}
+		expires := "never"
+		if !rec.Expires.IsZero() {
+			expires = rec.Expires.UTC().Format(expiresLayout)
+		}
+		fmt.Fprintf(w, `<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td><a href="domain-rr-edit.php?domain_id=%s&amp;rr_id=%d">edit</a></td></tr>`+"\n",
+			html.EscapeString(name), rec.Type, ttl, html.EscapeString(rec.Data), expires, domainID, rec.ID)
+	}
+	fmt.Fprintln(w, "</table></body></html>")
+}
+
+func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domainID := r.FormValue("domain_id")
+	if _, ok := s.domains[domainID]; !ok {
+		http.Error(w, "No such domain", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.FormValue("do_delete") == "1":
+		rec, err := s.lookup(domainID, r.FormValue("rr_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		delete(s.records, rec.ID)
+
+	case r.FormValue("do_change") == "1":
+		rec, err := recordFromForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec.DomainID = domainID
+		if r.FormValue("do_add") == "1" {
+			s.insert(rec)
+			break
+		}
+		existing, err := s.lookup(domainID, r.FormValue("rr_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		rec.ID = existing.ID
+		*existing = rec
+
+	default:
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Like the real UI, show the domain's records after a change
+	s.renderDomain(w, domainID)
+}
+
+func (s *Server) lookup(domainID, rrID string) (*Record, error) {
+	id, err := strconv.Atoi(rrID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rr_id %q", rrID)
+	}
+	rec, ok := s.records[id]
+	if !ok || rec.DomainID != domainID {
+		return nil, fmt.Errorf("no record %d in domain %s", id, domainID)
+	}
+	return rec, nil
+}
+
+// recordFromForm reads the record fields of the edit form
+func recordFromForm(r *http.Request) (Record, error) {
+	recordType, ok := rrTypes[r.FormValue("rr_type_id")]
+	if !ok {
+		return Record{}, fmt.Errorf("invalid rr_type_id %q", r.FormValue("rr_type_id"))
+	}
+
+	rec := Record{
+		Name: r.FormValue("name"),
+		Type: recordType,
+		Data: r.FormValue("data"),
+	}
+	if recordType == "CAA" {
+		rec.Data = fmt.Sprintf("%s %s %q", r.FormValue("caa_flags"), r.FormValue("caa_tag"), r.FormValue("caa_value"))
+	}
+	if rec.Data == "" {
+		return Record{}, fmt.Errorf("data is required")
+	}
+	if ttl := r.FormValue("ttl"); ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid ttl %q", ttl)
+		}
+		rec.TTL = seconds
+	}
+	if expires := r.FormValue("expires"); expires != "" {
+		minutes, ok := strings.CutSuffix(expires, " minutes")
+		n, err := strconv.Atoi(minutes)
+		if !ok || err != nil {
+			return Record{}, fmt.Errorf("invalid expires %q", expires)
+		}
+		rec.Expires = time.Now().Add(time.Duration(n) * time.Minute).Truncate(time.Second)
+	}
+	return rec, nil
+}
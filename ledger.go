@@ -0,0 +1,230 @@
+package tarka
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+// ledgerEntry records a Tarka record created by this provider
+type ledgerEntry struct {
+	Zone     string    `json:"zone"`
+	DomainID string    `json:"domain_id"`
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	DataHash string    `json:"data_hash"`
+	Created  time.Time `json:"created"`
+
+	// Expires is when Tarka will remove the record, with the zero time meaning never
+	Expires time.Time `json:"expires,omitzero"`
+
+	// Certificate is the name an ACME challenge record was created to
+	// validate, derived from the record name; empty for other records
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// ledger tracks which Tarka records the provider created, so cleanup can
+// tell them apart from records added by hand in the web UI. Entries are kept
+// in memory and, when storage is set, persisted one key per record so that
+// several Caddy instances sharing storage can add entries without conflict.
+type ledger struct {
+	mu      sync.Mutex
+	entries map[string]ledgerEntry // keyed by ledgerKey
+
+	// storage persists entries under prefix; nil keeps the ledger in memory only
+	storage certmagic.Storage
+	prefix  string
+}
+
+func ledgerKey(domainID, id string) string {
+	return domainID + "/" + id
+}
+
+// storagePrefix returns the storage prefix for data of a kind ("ledger",
+// "snapshots") kept for a Tarka instance, identified by the host and path of
+// its base URL
+func storagePrefix(kind, baseURL string) string {
+	host, urlPath := baseURL, ""
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		host, urlPath = u.Host, strings.Trim(u.Path, "/")
+	}
+	prefix := path.Join("tarka", kind, certmagic.StorageKeys.Safe(host))
+	if urlPath != "" {
+		prefix = path.Join(prefix, certmagic.StorageKeys.Safe(strings.ReplaceAll(urlPath, "/", "_")))
+	}
+	return prefix
+}
+
+func (l *ledger) storageKey(domainID, id string) string {
+	return path.Join(l.prefix, certmagic.StorageKeys.Safe(domainID), certmagic.StorageKeys.Safe(id)+".json")
+}
+
+// load replaces the in-memory entries with those in storage, picking up
+// records created before a restart or by other instances
+func (l *ledger) load(ctx context.Context) error {
+	if l.storage == nil {
+		return nil
+	}
+
+	keys, err := l.storage.List(ctx, l.prefix, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list ledger: %w", err)
+	}
+
+	entries := make(map[string]ledgerEntry, len(keys))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		data, err := l.storage.Load(ctx, key)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return fmt.Errorf("failed to load ledger entry %s: %w", key, err)
+		}
+		var entry ledgerEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to decode ledger entry %s: %w", key, err)
+		}
+		entries[ledgerKey(entry.DomainID, entry.ID)] = entry
+	}
+
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+	return nil
+}
+
+// add records a created record. Records without a known ID can't be
+// referred to later, so they are not tracked.
+func (l *ledger) add(ctx context.Context, entry ledgerEntry) error {
+	if entry.ID == "" {
+		return nil
+	}
+	l.mu.Lock()
+	if l.entries == nil {
+		l.entries = make(map[string]ledgerEntry)
+	}
+	l.entries[ledgerKey(entry.DomainID, entry.ID)] = entry
+	l.mu.Unlock()
+
+	if l.storage == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return l.storage.Store(ctx, l.storageKey(entry.DomainID, entry.ID), data)
+}
+
+// remove forgets a record, e.g. once it has been deleted
+func (l *ledger) remove(ctx context.Context, domainID, id string) error {
+	l.mu.Lock()
+	delete(l.entries, ledgerKey(domainID, id))
+	l.mu.Unlock()
+
+	if l.storage == nil {
+		return nil
+	}
+	err := l.storage.Delete(ctx, l.storageKey(domainID, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// owns reports whether a record was created by this provider, consulting
+// storage for records added by other instances since the ledger was loaded
+func (l *ledger) owns(ctx context.Context, domainID, id string) bool {
+	l.mu.Lock()
+	_, ok := l.entries[ledgerKey(domainID, id)]
+	l.mu.Unlock()
+	if ok || l.storage == nil {
+		return ok
+	}
+	return l.storage.Exists(ctx, l.storageKey(domainID, id))
+}
+
+// list returns the tracked records, oldest first
+func (l *ledger) list() []ledgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]ledgerEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	return entries
+}
+
+// dataHash returns a digest of record data, so the ledger can identify a
+// record's value without storing challenge tokens or other contents
+func dataHash(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// challengeCertificate returns the domain an ACME challenge record name is
+// for, e.g. www.example.com for _acme-challenge.www in zone example.com.
+func challengeCertificate(name, zone string) string {
+	if name != "_acme-challenge" && !strings.HasPrefix(name, "_acme-challenge.") {
+		return ""
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(name, "_acme-challenge"), ".")
+	zone = strings.TrimSuffix(zone, ".")
+	if rest == "" {
+		return zone
+	}
+	return rest + "." + zone
+}
+
+// recordCreated adds a record the provider just created to the ledger, with
+// the certificate it validates if it is an ACME challenge record
+func (p *Provider) recordCreated(ctx context.Context, zone, domainID string, rec client.Record, certificate string) {
+	err := p.ledger.add(ctx, ledgerEntry{
+		Zone:        zone,
+		DomainID:    domainID,
+		ID:          rec.ID,
+		Name:        rec.Name,
+		Type:        rec.Type,
+		DataHash:    dataHash(rec.Data),
+		Created:     time.Now(),
+		Expires:     rec.Expires,
+		Certificate: certificate,
+	})
+	if err != nil {
+		// The record exists but is unowned, so cleanup will leave it alone
+		p.log.Warn("failed to add record to ledger", zap.String("id", rec.ID), zap.Error(err))
+	}
+}
+
+// recordDeleted removes a record the provider just deleted from the ledger
+func (p *Provider) recordDeleted(ctx context.Context, domainID, id string) {
+	if p.DryRun {
+		// Nothing was deleted
+		return
+	}
+	if err := p.ledger.remove(ctx, domainID, id); err != nil {
+		p.log.Warn("failed to remove record from ledger", zap.String("id", id), zap.Error(err))
+	}
+}
@@ -0,0 +1,76 @@
+package tarka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestLedger_Persists(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+
+	p := newTestProvider(server.URL)
+	p.ledger.storage = storage
+	p.ledger.prefix = storagePrefix("ledger", server.BaseURL())
+	appended, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge.www", Text: "token"},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	id := appended[0].(libdns.TXT).ProviderData.(ProviderData).ID
+
+	// A second instance sharing the storage sees the entry once loaded
+	other := newTestProvider(server.URL)
+	other.ledger.storage = storage
+	other.ledger.prefix = storagePrefix("ledger", server.BaseURL())
+	if err := other.ledger.load(ctx); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	entries := other.ledger.list()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 ledger entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.ID != id || entry.Zone != "example.com." || entry.DomainID != "123" || entry.Type != "TXT" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry.Certificate != "www.example.com" {
+		t.Errorf("expected certificate www.example.com, got %q", entry.Certificate)
+	}
+	if entry.DataHash != dataHash("token") {
+		t.Errorf("expected the data hash of the record, got %q", entry.DataHash)
+	}
+
+	// Deleting through the second instance removes it from storage too
+	deleted, err := other.DeleteRecords(ctx, "example.com.", []libdns.Record{libdns.TXT{Name: "_acme-challenge.www", Text: "token"}})
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("expected 1 record deleted, got %d, err %v", len(deleted), err)
+	}
+	if storage.Exists(ctx, other.ledger.storageKey("123", id)) {
+		t.Error("expected the entry to be removed from storage")
+	}
+}
+
+func TestChallengeCertificate(t *testing.T) {
+	tests := []struct {
+		name, zone, want string
+	}{
+		{"_acme-challenge", "example.com.", "example.com"},
+		{"_acme-challenge.www", "example.com.", "www.example.com"},
+		{"www", "example.com.", ""},
+	}
+	for _, tc := range tests {
+		if got := challengeCertificate(tc.name, tc.zone); got != tc.want {
+			t.Errorf("challengeCertificate(%q, %q) = %q, want %q", tc.name, tc.zone, got, tc.want)
+		}
+	}
+}
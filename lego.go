@@ -0,0 +1,132 @@
+package tarka
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// legoRequestTimeout bounds the Tarka calls made to present or clean up one
+// challenge, as lego's interface takes no context
+const legoRequestTimeout = 2 * time.Minute
+
+// legoPropagationTimeout is how long lego waits for a challenge record to be
+// served before giving up, if checking every PropogationWaitTime doesn't take
+// longer. Tarka takes a little while to publish changes.
+const legoPropagationTimeout = 2 * time.Minute
+
+// legoChallengeProvider mirrors lego's challenge.Provider
+type legoChallengeProvider interface {
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// legoProviderTimeout mirrors lego's challenge.ProviderTimeout
+type legoProviderTimeout interface {
+	legoChallengeProvider
+	Timeout() (timeout, interval time.Duration)
+}
+
+// LegoProvider adapts a Provider to lego's challenge.Provider and
+// challenge.ProviderTimeout interfaces, so tools built on lego can solve
+// DNS-01 challenges through Tarka with the same provider settings as Caddy.
+// The interfaces are met structurally; this package doesn't import lego.
+//
+//	p, err := tarka.NewLegoProvider(&tarka.Provider{Username: user, Password: pass})
+//	...
+//	defer p.Close()
+//	client.Challenge.SetDNS01Provider(p)
+type LegoProvider struct {
+	provider *Provider
+	cancel   context.CancelFunc
+}
+
+// NewLegoProvider provisions p for use outside Caddy and returns an adapter
+// for it. Without Caddy's storage, the ledger and zone locks are kept in
+// memory. Close it when done.
+func NewLegoProvider(p *Provider) (*LegoProvider, error) {
+	ctx, cancel := StandaloneContext(context.Background(), nil)
+	if err := p.Provision(ctx); err != nil {
+		cancel()
+		return nil, fmt.Errorf("provisioning provider: %w", err)
+	}
+	return &LegoProvider{provider: p, cancel: cancel}, nil
+}
+
+// Present creates the TXT record for a DNS-01 challenge of domain
+func (l *LegoProvider) Present(domain, token, keyAuth string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), legoRequestTimeout)
+	defer cancel()
+
+	zone, record, err := l.challengeRecord(ctx, domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	if _, err := l.provider.AppendRecords(ctx, zone, []libdns.Record{record}); err != nil {
+		return fmt.Errorf("failed to present challenge for %s: %w", domain, err)
+	}
+	return nil
+}
+
+// CleanUp removes the TXT record Present created
+func (l *LegoProvider) CleanUp(domain, token, keyAuth string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), legoRequestTimeout)
+	defer cancel()
+
+	zone, record, err := l.challengeRecord(ctx, domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	if _, err := l.provider.DeleteRecords(ctx, zone, []libdns.Record{record}); err != nil {
+		return fmt.Errorf("failed to clean up challenge for %s: %w", domain, err)
+	}
+	return nil
+}
+
+// Timeout tells lego to check for the record every PropogationWaitTime, for
+// up to legoPropagationTimeout or ten checks, whichever is longer
+func (l *LegoProvider) Timeout() (timeout, interval time.Duration) {
+	interval = l.provider.PropogationWaitTime
+	return max(legoPropagationTimeout, 10*interval), interval
+}
+
+// Close stops the provider. Implements io.Closer.
+func (l *LegoProvider) Close() error {
+	l.cancel()
+	return l.provider.Cleanup()
+}
+
+// challengeRecord returns the TXT record for a challenge of domain, as lego
+// computes it, along with the account's zone to write it in: the most
+// specific one holding the record's name. If no zone does, the record is
+// given relative to domain, for a delegation to route it.
+func (l *LegoProvider) challengeRecord(ctx context.Context, domain, keyAuth string) (string, libdns.Record, error) {
+	fqdn, err := normalizeZone("_acme-challenge." + domain)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	record := libdns.TXT{Text: base64.RawURLEncoding.EncodeToString(sum[:])}
+
+	c, err := l.provider.getClient()
+	if err != nil {
+		return "", nil, err
+	}
+	target, name, ok, err := l.provider.targetZone(ctx, c, fqdn)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		record.Name = "_acme-challenge"
+		return domain, record, nil
+	}
+	record.Name = libdnsName(name, target.zone)
+	return target.zone, record, nil
+}
+
+// Interface guards
+var _ legoProviderTimeout = (*LegoProvider)(nil)
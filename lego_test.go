@@ -0,0 +1,70 @@
+package tarka
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestLegoProvider(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddDomain("124", "dev.example.com")
+
+	l, err := NewLegoProvider(&Provider{
+		Username: tarkatest.Username,
+		Password: tarkatest.Password,
+		BaseURL:  server.BaseURL(),
+	})
+	if err != nil {
+		t.Fatalf("NewLegoProvider failed: %v", err)
+	}
+	defer l.Close()
+
+	sum := sha256.Sum256([]byte("token.thumbprint"))
+	value := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// The record goes in the most specific zone
+	if err := l.Present("www.dev.example.com", "token", "token.thumbprint"); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	if len(server.Records("123")) != 0 {
+		t.Errorf("expected nothing in example.com, got %+v", server.Records("123"))
+	}
+	records, err := l.provider.GetRecords(context.Background(), "dev.example.com")
+	if err != nil {
+		t.Fatalf("GetRecords failed: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %+v", records)
+	}
+	if txt, ok := records[0].(libdns.TXT); !ok || txt.Name != "_acme-challenge.www" || txt.Text != value {
+		t.Errorf("expected _acme-challenge.www TXT %s, got %+v", value, records[0])
+	}
+
+	if err := l.CleanUp("www.dev.example.com", "token", "token.thumbprint"); err != nil {
+		t.Fatalf("CleanUp failed: %v", err)
+	}
+	if len(server.Records("124")) != 0 {
+		t.Errorf("expected the record to be removed, got %+v", server.Records("124"))
+	}
+
+	if err := l.Present("example.org", "token", "token.thumbprint"); err == nil {
+		t.Error("expected an error for a domain outside the account")
+	}
+
+	timeout, interval := l.Timeout()
+	if interval != 5*time.Second || timeout != legoPropagationTimeout {
+		t.Errorf("unexpected timeout %v and interval %v", timeout, interval)
+	}
+	l.provider.PropogationWaitTime = time.Minute
+	if timeout, _ := l.Timeout(); timeout != 10*time.Minute {
+		t.Errorf("expected the timeout to allow ten checks, got %v", timeout)
+	}
+}
@@ -0,0 +1,56 @@
+package tarka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// defaultLockTimeout is how long to wait for another instance to finish
+// changing a zone before giving up
+const defaultLockTimeout = time.Minute
+
+// zoneLockName returns the storage lock name for a Tarka domain. Like the
+// ledger's keys, it is built from the host and path of the base URL and the
+// domain ID, so it identifies the zone across every instance sharing the
+// storage however the base URL is written.
+func zoneLockName(baseURL, domainID string) string {
+	return path.Join(storagePrefix("locks", baseURL), certmagic.StorageKeys.Safe(domainID))
+}
+
+// lockZone takes the storage lock for a domain, so read-modify-write changes
+// to it are serialized across Caddy instances sharing the storage. The
+// returned function releases the lock. Without storage, as when the provider
+// is used outside Caddy, nothing is locked.
+func (p *Provider) lockZone(ctx context.Context, baseURL, domainID string) (func(), error) {
+	if p.storage == nil {
+		return func() {}, nil
+	}
+
+	timeout := p.LockTimeout
+	if timeout <= 0 {
+		timeout = defaultLockTimeout
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	name := zoneLockName(baseURL, domainID)
+	if err := p.storage.Lock(lockCtx, name); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, fmt.Errorf("timed out after %v waiting for lock on domain %s", timeout, domainID)
+		}
+		return nil, fmt.Errorf("failed to lock domain %s: %w", domainID, err)
+	}
+
+	return func() {
+		// Release the lock even if the operation's context was cancelled
+		if err := p.storage.Unlock(context.WithoutCancel(ctx), name); err != nil {
+			p.log.Warn("failed to release zone lock", zap.String("domain_id", domainID), zap.Error(err))
+		}
+	}, nil
+}
@@ -0,0 +1,69 @@
+package tarka
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestProvider_LocksZone(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	ctx := context.Background()
+
+	p := newTestProvider(server.URL)
+	p.storage = storage
+	p.LockTimeout = 200 * time.Millisecond
+
+	// Another instance is changing the zone
+	name := zoneLockName(server.BaseURL(), "123")
+	if err := storage.Lock(ctx, name); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	records := []libdns.Record{libdns.RR{Name: "www", Type: "A", Data: "192.0.2.1"}}
+	_, err := p.SetRecords(ctx, "example.com.", records)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a lock timeout, got: %v", err)
+	}
+	if len(server.Records("123")) != 0 {
+		t.Error("expected the zone not to be changed while locked")
+	}
+
+	if err := storage.Unlock(ctx, name); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if _, err := p.SetRecords(ctx, "example.com.", records); err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+
+	// The provider released its lock, so it can be taken again
+	lockCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := storage.Lock(lockCtx, name); err != nil {
+		t.Fatalf("expected the provider to release the lock, got: %v", err)
+	}
+	storage.Unlock(ctx, name)
+}
+
+func TestZoneLockName(t *testing.T) {
+	name := zoneLockName("https://tarka.example.net/custdata", "123")
+	if name != "tarka/locks/tarka.example.net/custdata/123" {
+		t.Errorf("unexpected lock name %q", name)
+	}
+	if other := zoneLockName("https://TARKA.example.net/custdata/", "123"); other != name {
+		t.Errorf("expected the same lock for an equivalent base URL, got %q", other)
+	}
+	// Another Tarka instance on the same host has its own locks
+	if other := zoneLockName("https://tarka.example.net/staging/custdata", "123"); other == name {
+		t.Errorf("expected a different lock for another path, got %q", other)
+	}
+}
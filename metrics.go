@@ -0,0 +1,181 @@
+package tarka
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors for the provider. Providers
+// provisioned in the same Caddy config share one set, registered with the
+// config's metrics registry. A nil *metrics records nothing.
+type metrics struct {
+	logins          *prometheus.CounterVec
+	sessionChecks   *prometheus.CounterVec
+	recordChanges   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	pendingExpiry   *pendingExpiryCollector
+}
+
+// newMetrics registers the provider's collectors with reg, reusing any
+// already registered there by another provider instance
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	const ns, sub = "caddy", "dns_tarka"
+	m := &metrics{
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "logins_total",
+			Help:      "Logins to the Tarka web UI, by outcome.",
+		}, []string{"outcome"}),
+		sessionChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "session_checks_total",
+			Help:      "Revalidations of the Tarka session, by whether it was still valid.",
+		}, []string{"result"}),
+		recordChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "record_changes_total",
+			Help:      "Records added to, updated in or deleted from Tarka, by operation, record type and outcome.",
+		}, []string{"operation", "type", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests to the Tarka web UI, by page and outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint", "outcome"}),
+		pendingExpiry: &pendingExpiryCollector{
+			desc: prometheus.NewDesc(prometheus.BuildFQName(ns, sub, "records_pending_expiry"),
+				"Records created by the provider that Tarka has yet to expire.", nil, nil),
+			ledgers: make(map[*ledger]struct{}),
+		},
+	}
+
+	var err error
+	if m.logins, err = register(reg, m.logins); err != nil {
+		return nil, err
+	}
+	if m.sessionChecks, err = register(reg, m.sessionChecks); err != nil {
+		return nil, err
+	}
+	if m.recordChanges, err = register(reg, m.recordChanges); err != nil {
+		return nil, err
+	}
+	if m.requestDuration, err = register(reg, m.requestDuration); err != nil {
+		return nil, err
+	}
+	if m.pendingExpiry, err = register(reg, m.pendingExpiry); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// register registers c with reg, returning the equivalent collector if one
+// is already registered
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	err := reg.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// countChange counts a record add, update or delete, unless it was only a
+// dry run
+func (p *Provider) countChange(operation, recordType string, err error) {
+	if !p.DryRun {
+		p.metrics.recordChanged(operation, recordType, err)
+	}
+}
+
+// recordChanged counts a record add, update or delete
+func (m *metrics) recordChanged(operation, recordType string, err error) {
+	if m == nil {
+		return
+	}
+	m.recordChanges.WithLabelValues(operation, recordType, outcome(err)).Inc()
+}
+
+// LoggedIn implements client.Observer
+func (m *metrics) LoggedIn(err error) {
+	if m == nil {
+		return
+	}
+	m.logins.WithLabelValues(outcome(err)).Inc()
+}
+
+// SessionChecked implements client.Observer
+func (m *metrics) SessionChecked(valid bool) {
+	if m == nil {
+		return
+	}
+	result := "expired"
+	if valid {
+		result = "valid"
+	}
+	m.sessionChecks.WithLabelValues(result).Inc()
+}
+
+// RequestDone implements client.Observer
+func (m *metrics) RequestDone(endpoint string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.WithLabelValues(endpoint, outcome(err)).Observe(duration.Seconds())
+}
+
+// pendingExpiryCollector reports how many ledger records have an expiry
+// still in the future, across the ledgers of every provider using it
+type pendingExpiryCollector struct {
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	ledgers map[*ledger]struct{}
+}
+
+func (c *pendingExpiryCollector) track(l *ledger) {
+	c.mu.Lock()
+	c.ledgers[l] = struct{}{}
+	c.mu.Unlock()
+}
+
+// untrack stops counting a ledger, once its provider is cleaned up
+func (c *pendingExpiryCollector) untrack(l *ledger) {
+	c.mu.Lock()
+	delete(c.ledgers, l)
+	c.mu.Unlock()
+}
+
+func (c *pendingExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *pendingExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	pending := 0
+	for l := range c.ledgers {
+		for _, entry := range l.list() {
+			if entry.Expires.After(now) {
+				pending++
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(pending))
+}
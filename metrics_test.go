@@ -0,0 +1,102 @@
+package tarka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	if err != nil {
+		t.Fatalf("newMetrics failed: %v", err)
+	}
+	// A second provider in the same config shares the collectors
+	if again, err := newMetrics(reg); err != nil || again.logins != m.logins {
+		t.Fatalf("expected registered collectors to be reused, got err %v", err)
+	}
+
+	p := newTestProvider(server.URL)
+	p.metrics = m
+	m.pendingExpiry.track(&p.ledger)
+	ctx := context.Background()
+
+	_, err = p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token"},
+		libdns.RR{Name: "www", Type: "A", Data: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+
+	if got := testutil.ToFloat64(m.logins.WithLabelValues("success")); got != 1 {
+		t.Errorf("expected 1 successful login, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.recordChanges.WithLabelValues("add", "TXT", "success")); got != 1 {
+		t.Errorf("expected 1 TXT add, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.recordChanges.WithLabelValues("add", "A", "success")); got != 1 {
+		t.Errorf("expected 1 A add, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.requestDuration); got == 0 {
+		t.Error("expected request latencies to be observed")
+	}
+
+	// Changing only the TTL is an update
+	if _, err := p.SetRecords(ctx, "example.com.", []libdns.Record{
+		libdns.RR{Name: "www", Type: "A", TTL: 5 * time.Minute, Data: "192.0.2.1"},
+	}); err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+	if got := testutil.ToFloat64(m.recordChanges.WithLabelValues("update", "A", "success")); got != 1 {
+		t.Errorf("expected 1 A update, got %v", got)
+	}
+
+	// Failed requests are told apart from successful ones
+	if err := p.client.DeleteRecord(ctx, "999", "1"); err == nil {
+		t.Fatal("expected deleting from a missing domain to fail")
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering from the registry failed: %v", err)
+	}
+	var failures uint64
+	for _, family := range families {
+		if family.GetName() != "caddy_dns_tarka_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "outcome" && label.GetValue() == "failure" {
+					failures += metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	if failures != 1 {
+		t.Errorf("expected 1 failed request, got %d", failures)
+	}
+	// Only the challenge record expires
+	if got := testutil.ToFloat64(m.pendingExpiry); got != 1 {
+		t.Errorf("expected 1 record pending expiry, got %v", got)
+	}
+	// Cleaned up providers are no longer counted
+	p.Cleanup()
+	if got := testutil.ToFloat64(m.pendingExpiry); got != 0 {
+		t.Errorf("expected no records pending expiry after cleanup, got %v", got)
+	}
+	// The pedantic registry checks collectors describe what they collect
+	if _, err := reg.Gather(); err != nil {
+		t.Errorf("gathering from the registry failed: %v", err)
+	}
+}
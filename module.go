@@ -1,18 +1,24 @@
 package tarka
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"time"
 
 	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
 )
 
 func init() {
-	caddy.RegisterModule(Provider{})
+	caddy.RegisterModule(new(Provider))
 }
 
 // CaddyModule returns the Caddy module information.
-func (Provider) CaddyModule() caddy.ModuleInfo {
+func (*Provider) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID: "dns.providers.tarka",
 		New: func() caddy.Module {
@@ -29,15 +35,153 @@ func (p *Provider) Provision(ctx caddy.Context) error {
 	p.Username = caddy.NewReplacer().ReplaceAll(p.Username, "")
 	p.Password = caddy.NewReplacer().ReplaceAll(p.Password, "")
 	p.DomainID = caddy.NewReplacer().ReplaceAll(p.DomainID, "")
+	if p.Transport != nil {
+		p.Transport.Proxy = caddy.NewReplacer().ReplaceAll(p.Transport.Proxy, "")
+		p.Transport.CAFile = caddy.NewReplacer().ReplaceAll(p.Transport.CAFile, "")
+		for name, value := range p.Transport.Headers {
+			p.Transport.Headers[name] = caddy.NewReplacer().ReplaceAll(value, "")
+		}
+	}
 
 	// Set the default propagation wait time if it hasn't been set in the Caddyfile.
 	if p.PropogationWaitTime == 0 {
 		p.PropogationWaitTime = 5 * time.Second
 	}
+	switch p.TTLPolicy {
+	case "", TTLPolicyClamp, TTLPolicyReject:
+	default:
+		return fmt.Errorf("invalid ttl_policy %q: must be %s or %s", p.TTLPolicy, TTLPolicyClamp, TTLPolicyReject)
+	}
+	if p.DefaultTTL < 0 {
+		return fmt.Errorf("invalid default_ttl %v: must not be negative", p.DefaultTTL)
+	}
+	if _, err := p.effectiveTTL(p.DefaultTTL); err != nil {
+		return fmt.Errorf("invalid default_ttl: %w", err)
+	}
+	if p.LockTimeout < 0 {
+		return fmt.Errorf("invalid lock_timeout %v: must not be negative", p.LockTimeout)
+	}
+	if p.LockTimeout == 0 {
+		p.LockTimeout = defaultLockTimeout
+	}
+	for i, d := range p.Delegations {
+		if d.Name == "" || d.Target == "" {
+			return fmt.Errorf("delegation %d needs a name and target", i)
+		}
+		if d.DomainID != "" && d.Zone == "" {
+			return fmt.Errorf("delegation of %s has a domain_id but no zone", d.Name)
+		}
+	}
+	if p.FollowCNAMEs != nil {
+		for i, resolver := range p.FollowCNAMEs.Resolvers {
+			p.FollowCNAMEs.Resolvers[i] = withDefaultPort(resolver, "53")
+		}
+	}
+	if p.SessionCheckInterval == 0 {
+		p.SessionCheckInterval = client.DefaultSessionCheckInterval
+	}
 	p.log = caddy.Log().Named("dns.providers.tarka")
+	if p.DryRun {
+		p.log = p.log.With(zap.Bool("dry_run", true))
+		p.log.Warn("dry run: record changes will be logged but not made")
+	}
+
+	// Metrics must be set up before the client is created, as it reports to them
+	if reg := ctx.GetMetricsRegistry(); reg != nil {
+		m, err := newMetrics(reg)
+		if err != nil {
+			return fmt.Errorf("failed to register metrics: %w", err)
+		}
+		m.pendingExpiry.track(&p.ledger)
+		p.metrics = m
+	}
+
+	// Likewise tracing
+	if p.Tracing != nil {
+		if err := p.setupTracing(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Build the client now so transport config errors surface at load time
+	c, err := p.getClient()
+	if err != nil {
+		return err
+	}
+
+	// Keep the ledger and zone locks in Caddy's storage, so records created
+	// before a restart or by other instances sharing the storage are still
+	// owned, and changes to a zone from different instances don't interleave
+	p.storage = contextStorage(ctx)
+	p.ledger.storage = p.storage
+	p.ledger.prefix = storagePrefix("ledger", c.BaseURL())
+	if err := p.ledger.load(ctx); err != nil {
+		return err
+	}
+	if p.Snapshots != nil {
+		p.Snapshots.Dir = caddy.NewReplacer().ReplaceAll(p.Snapshots.Dir, "")
+		if err := p.setupSnapshots(c.BaseURL()); err != nil {
+			return err
+		}
+	}
+	if p.Audit != nil {
+		p.Audit.Path = caddy.NewReplacer().ReplaceAll(p.Audit.Path, "")
+		if err := p.setupAudit(c.BaseURL()); err != nil {
+			return err
+		}
+	}
+
+	// The context is cancelled when this config is unloaded, stopping the sweeper
+	if p.Sweeper != nil {
+		go p.runSweeper(ctx)
+	}
+
+	// Let the admin API manage the zones through this provider's session
+	registerProvider(p)
 	return nil
 }
 
+// Cleanup takes the provider out of the admin API, closes the audit log and
+// flushes any spans not yet exported. Implements caddy.CleanerUpper.
+func (p *Provider) Cleanup() error {
+	unregisterProvider(p)
+	if p.metrics != nil {
+		p.metrics.pendingExpiry.untrack(&p.ledger)
+	}
+	if p.auditSink != nil {
+		if err := p.auditSink.close(); err != nil {
+			p.log.Warn("failed to close audit log", zap.Error(err))
+		}
+	}
+	if p.shutdownTracing != nil {
+		return p.shutdownTracing(context.Background())
+	}
+	return nil
+}
+
+// standaloneStorage is the context value StandaloneContext stores, so a nil
+// storage can be told apart from no value
+type standaloneStorage struct {
+	storage certmagic.Storage
+}
+
+// StandaloneContext returns a context for provisioning a Provider outside a
+// Caddy config, which has no storage of its own. The ledger and zone locks
+// are kept in storage, or in memory if it's nil. Call cancel when done.
+func StandaloneContext(parent context.Context, storage certmagic.Storage) (caddy.Context, context.CancelFunc) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: parent})
+	return ctx.WithValue(standaloneStorage{}, standaloneStorage{storage: storage}), cancel
+}
+
+// contextStorage returns the storage given to StandaloneContext, or else the
+// storage configured for Caddy
+func contextStorage(ctx caddy.Context) certmagic.Storage {
+	if standalone, ok := ctx.Value(standaloneStorage{}).(standaloneStorage); ok {
+		return standalone.storage
+	}
+	return ctx.Storage()
+}
+
 // Expansion of placeholders in the API token is left to the JSON config caddy.Provisioner (above).
 func (p *Provider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -78,6 +222,127 @@ func (p *Provider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if d.NextArg() {
 					return d.ArgErr()
 				}
+			case "session_check_interval":
+				if d.NextArg() {
+					duration, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid duration for session_check_interval: %v", err)
+					}
+					p.SessionCheckInterval = duration
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "default_ttl":
+				if d.NextArg() {
+					duration, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid duration for default_ttl: %v", err)
+					}
+					p.DefaultTTL = duration
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "ttl_policy":
+				if d.NextArg() {
+					p.TTLPolicy = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if p.TTLPolicy != TTLPolicyClamp && p.TTLPolicy != TTLPolicyReject {
+					return d.Errf("invalid ttl_policy '%s': must be %s or %s", p.TTLPolicy, TTLPolicyClamp, TTLPolicyReject)
+				}
+			case "lock_timeout":
+				if d.NextArg() {
+					duration, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid duration for lock_timeout: %v", err)
+					}
+					p.LockTimeout = duration
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "dry_run":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				p.DryRun = true
+			case "delete_unowned":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				p.DeleteUnowned = true
+			case "tracing":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if p.Tracing == nil {
+					p.Tracing = new(TracingConfig)
+				}
+				if err := unmarshalTracing(d, p.Tracing); err != nil {
+					return err
+				}
+			case "delegate":
+				args := d.RemainingArgs()
+				if len(args) < 2 || len(args) > 4 {
+					return d.ArgErr()
+				}
+				delegation := Delegation{Name: args[0], Target: args[1]}
+				if len(args) > 2 {
+					delegation.Zone = args[2]
+				}
+				if len(args) > 3 {
+					delegation.DomainID = args[3]
+				}
+				p.Delegations = append(p.Delegations, delegation)
+			case "follow_cnames":
+				if p.FollowCNAMEs == nil {
+					p.FollowCNAMEs = new(CNAMEFollowing)
+				}
+				p.FollowCNAMEs.Resolvers = append(p.FollowCNAMEs.Resolvers, d.RemainingArgs()...)
+			case "snapshots":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if p.Snapshots == nil {
+					p.Snapshots = new(SnapshotConfig)
+				}
+				if err := unmarshalSnapshots(d, p.Snapshots); err != nil {
+					return err
+				}
+			case "audit":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if p.Audit == nil {
+					p.Audit = new(AuditConfig)
+				}
+				if err := unmarshalAudit(d, p.Audit); err != nil {
+					return err
+				}
+			case "sweeper":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if p.Sweeper == nil {
+					p.Sweeper = new(SweeperConfig)
+				}
+				if err := unmarshalSweeper(d, p.Sweeper); err != nil {
+					return err
+				}
+			case "transport":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if p.Transport == nil {
+					p.Transport = new(client.TransportConfig)
+				}
+				if err := unmarshalTransport(d, p.Transport); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective '%s'", d.Val())
 			}
@@ -89,8 +354,178 @@ func (p *Provider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if p.Password == "" {
 		return d.Err("missing 'password'")
 	}
-	if p.DomainID == "" {
-		return d.Err("missing 'domain_id'")
+	return nil
+}
+
+// unmarshalSweeper parses the body of a sweeper block:
+//
+//	sweeper {
+//		interval <duration>
+//		max_age  <duration>
+//	}
+func unmarshalSweeper(d *caddyfile.Dispenser, s *SweeperConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "interval", "max_age":
+			name := d.Val()
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid duration for %s: %v", name, err)
+			}
+			if name == "interval" {
+				s.Interval = duration
+			} else {
+				s.MaxAge = duration
+			}
+		default:
+			return d.Errf("unrecognized sweeper subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalTracing parses the body of a tracing block, which may be empty:
+//
+//	tracing {
+//		endpoint <url>
+//	}
+func unmarshalTracing(d *caddyfile.Dispenser, t *TracingConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "endpoint":
+			if !d.AllArgs(&t.Endpoint) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized tracing subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalSnapshots parses the body of a snapshots block, which may be empty:
+//
+//	snapshots {
+//		dir  <path>
+//		keep <count>
+//	}
+func unmarshalSnapshots(d *caddyfile.Dispenser, s *SnapshotConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "dir":
+			if !d.AllArgs(&s.Dir) {
+				return d.ArgErr()
+			}
+		case "keep":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			keep, err := strconv.Atoi(value)
+			if err != nil || keep < 1 {
+				return d.Errf("invalid snapshot keep '%s': must be a positive number", value)
+			}
+			s.Keep = keep
+		default:
+			return d.Errf("unrecognized snapshots subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalAudit parses the body of an audit block:
+//
+//	audit {
+//		sink file|log|storage
+//		path <file>
+//	}
+func unmarshalAudit(d *caddyfile.Dispenser, a *AuditConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "sink":
+			if !d.AllArgs(&a.Sink) {
+				return d.ArgErr()
+			}
+			switch a.Sink {
+			case AuditSinkFile, AuditSinkLog, AuditSinkStorage:
+			default:
+				return d.Errf("invalid audit sink '%s': must be %s, %s or %s", a.Sink, AuditSinkFile, AuditSinkLog, AuditSinkStorage)
+			}
+		case "path":
+			if !d.AllArgs(&a.Path) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized audit subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalTransport parses the body of a transport block:
+//
+//	transport {
+//		proxy            <url>
+//		ca_file          <path>
+//		tls_min_version  tls1.2|tls1.3
+//		dial_timeout     <duration>
+//		response_timeout <duration>
+//		user_agent       <string>
+//		header           <name> <value>
+//	}
+func unmarshalTransport(d *caddyfile.Dispenser, t *client.TransportConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "proxy":
+			if !d.AllArgs(&t.Proxy) {
+				return d.ArgErr()
+			}
+		case "ca_file":
+			if !d.AllArgs(&t.CAFile) {
+				return d.ArgErr()
+			}
+		case "tls_min_version":
+			if !d.AllArgs(&t.TLSMinVersion) {
+				return d.ArgErr()
+			}
+			if _, err := client.ParseTLSVersion(t.TLSMinVersion); err != nil {
+				return d.Err(err.Error())
+			}
+		case "dial_timeout", "response_timeout":
+			name := d.Val()
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid duration for %s: %v", name, err)
+			}
+			if name == "dial_timeout" {
+				t.DialTimeout = duration
+			} else {
+				t.ResponseTimeout = duration
+			}
+		case "user_agent":
+			if !d.AllArgs(&t.UserAgent) {
+				return d.ArgErr()
+			}
+		case "header":
+			var name, value string
+			if !d.AllArgs(&name, &value) {
+				return d.ArgErr()
+			}
+			if t.Headers == nil {
+				t.Headers = make(map[string]string)
+			}
+			t.Headers[name] = value
+		default:
+			return d.Errf("unrecognized transport subdirective '%s'", d.Val())
+		}
 	}
 	return nil
 }
@@ -99,4 +534,5 @@ func (p *Provider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 var (
 	_ caddyfile.Unmarshaler = (*Provider)(nil)
 	_ caddy.Provisioner     = (*Provider)(nil)
+	_ caddy.CleanerUpper    = (*Provider)(nil)
 )
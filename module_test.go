@@ -2,12 +2,13 @@ package tarka
 
 import (
 	"context"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/nsna/tarka/client"
 )
 
 func TestUnmarshalCaddyfile(t *testing.T) {
@@ -32,6 +33,18 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 				DomainID: "123",
 			},
 		},
+		{
+			name: "valid config without domain_id",
+			input: `tarka {
+				username  testuser
+				password  testpass
+			}`,
+			shouldErr: false,
+			expect: &Provider{
+				Username: "testuser",
+				Password: "testpass",
+			},
+		},
 		{
 			name: "valid config with propagation wait time",
 			input: `tarka {
@@ -48,6 +61,99 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 				PropogationWaitTime: 15 * time.Second,
 			},
 		},
+		{
+			name: "valid config with session check interval",
+			input: `tarka {
+				username  testuser
+				password  testpass
+				domain_id 123
+				session_check_interval 2m
+			}`,
+			shouldErr: false,
+			expect: &Provider{
+				Username:             "testuser",
+				Password:             "testpass",
+				DomainID:             "123",
+				SessionCheckInterval: 2 * time.Minute,
+			},
+		},
+		{
+			name: "valid config with lock timeout",
+			input: `tarka {
+				username     testuser
+				password     testpass
+				domain_id    123
+				lock_timeout 30s
+			}`,
+			shouldErr: false,
+			expect: &Provider{
+				Username:    "testuser",
+				Password:    "testpass",
+				DomainID:    "123",
+				LockTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name: "valid config with dry run",
+			input: `tarka {
+				username  testuser
+				password  testpass
+				domain_id 123
+				dry_run
+			}`,
+			shouldErr: false,
+			expect: &Provider{
+				Username: "testuser",
+				Password: "testpass",
+				DomainID: "123",
+				DryRun:   true,
+			},
+		},
+		{
+			name: "valid config with delete_unowned",
+			input: `tarka {
+				username  testuser
+				password  testpass
+				domain_id 123
+				delete_unowned
+			}`,
+			shouldErr: false,
+			expect: &Provider{
+				Username:      "testuser",
+				Password:      "testpass",
+				DomainID:      "123",
+				DeleteUnowned: true,
+			},
+		},
+		{
+			name: "valid config with TTL settings",
+			input: `tarka {
+				username    testuser
+				password    testpass
+				domain_id   123
+				default_ttl 5m
+				ttl_policy  reject
+			}`,
+			shouldErr: false,
+			expect: &Provider{
+				Username:   "testuser",
+				Password:   "testpass",
+				DomainID:   "123",
+				DefaultTTL: 5 * time.Minute,
+				TTLPolicy:  TTLPolicyReject,
+			},
+		},
+		{
+			name: "invalid ttl policy",
+			input: `tarka {
+				username   test
+				password   test
+				domain_id  123
+				ttl_policy round
+			}`,
+			shouldErr: true,
+			wantErr:   "invalid ttl_policy 'round'",
+		},
 		{
 			name: "missing username",
 			input: `tarka {
@@ -119,11 +225,218 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 				if p.PropogationWaitTime != tc.expect.PropogationWaitTime {
 					t.Errorf("expected propagation_wait_time '%s', got '%s'", tc.expect.PropogationWaitTime, p.PropogationWaitTime)
 				}
+				if p.DefaultTTL != tc.expect.DefaultTTL {
+					t.Errorf("expected default_ttl '%s', got '%s'", tc.expect.DefaultTTL, p.DefaultTTL)
+				}
+				if p.TTLPolicy != tc.expect.TTLPolicy {
+					t.Errorf("expected ttl_policy '%s', got '%s'", tc.expect.TTLPolicy, p.TTLPolicy)
+				}
+				if p.SessionCheckInterval != tc.expect.SessionCheckInterval {
+					t.Errorf("expected session_check_interval '%s', got '%s'", tc.expect.SessionCheckInterval, p.SessionCheckInterval)
+				}
+				if p.LockTimeout != tc.expect.LockTimeout {
+					t.Errorf("expected lock_timeout '%s', got '%s'", tc.expect.LockTimeout, p.LockTimeout)
+				}
+				if p.DryRun != tc.expect.DryRun {
+					t.Errorf("expected dry_run %v, got %v", tc.expect.DryRun, p.DryRun)
+				}
+				if p.DeleteUnowned != tc.expect.DeleteUnowned {
+					t.Errorf("expected delete_unowned %v, got %v", tc.expect.DeleteUnowned, p.DeleteUnowned)
+				}
 			}
 		})
 	}
 }
 
+func TestUnmarshalCaddyfile_Transport(t *testing.T) {
+	input := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		transport {
+			proxy            http://proxy.internal:3128
+			ca_file          /etc/ssl/internal-ca.pem
+			tls_min_version  tls1.3
+			dial_timeout     5s
+			response_timeout 1m
+			user_agent       "dns-team/1.0"
+			header           X-Team dns
+		}
+	}`
+
+	p := new(Provider)
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	if p.Transport == nil {
+		t.Fatal("expected transport config to be set")
+	}
+	want := client.TransportConfig{
+		Proxy:           "http://proxy.internal:3128",
+		CAFile:          "/etc/ssl/internal-ca.pem",
+		TLSMinVersion:   "tls1.3",
+		DialTimeout:     5 * time.Second,
+		ResponseTimeout: time.Minute,
+		UserAgent:       "dns-team/1.0",
+	}
+	got := *p.Transport
+	if got.Headers["X-Team"] != "dns" {
+		t.Errorf("expected header X-Team 'dns', got %v", got.Headers)
+	}
+	got.Headers = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected transport %+v, got %+v", want, got)
+	}
+
+	bad := `tarka {
+		transport {
+			tls_min_version ssl3
+		}
+	}`
+	err := new(Provider).UnmarshalCaddyfile(caddyfile.NewTestDispenser(bad))
+	if err == nil || !strings.Contains(err.Error(), "unsupported tls_min_version") {
+		t.Errorf("expected unsupported tls_min_version error, got: %v", err)
+	}
+}
+
+func TestUnmarshalCaddyfile_Sweeper(t *testing.T) {
+	input := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		sweeper {
+			interval 5m
+			max_age  2h
+		}
+	}`
+
+	p := new(Provider)
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	if p.Sweeper == nil || p.Sweeper.Interval != 5*time.Minute || p.Sweeper.MaxAge != 2*time.Hour {
+		t.Errorf("unexpected sweeper config %+v", p.Sweeper)
+	}
+}
+
+func TestUnmarshalCaddyfile_Tracing(t *testing.T) {
+	input := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		tracing {
+			endpoint https://otel-collector:4317
+		}
+	}`
+
+	p := new(Provider)
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	if p.Tracing == nil || p.Tracing.Endpoint != "https://otel-collector:4317" {
+		t.Errorf("unexpected tracing config %+v", p.Tracing)
+	}
+}
+
+func TestUnmarshalCaddyfile_Audit(t *testing.T) {
+	input := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		audit {
+			sink file
+			path /var/log/tarka/audit.jsonl
+		}
+	}`
+
+	p := new(Provider)
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	if p.Audit == nil || p.Audit.Sink != AuditSinkFile || p.Audit.Path != "/var/log/tarka/audit.jsonl" {
+		t.Errorf("unexpected audit config %+v", p.Audit)
+	}
+
+	bad := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		audit {
+			sink syslog
+		}
+	}`
+	if err := new(Provider).UnmarshalCaddyfile(caddyfile.NewTestDispenser(bad)); err == nil {
+		t.Error("expected an error for an unknown sink")
+	}
+}
+
+func TestUnmarshalCaddyfile_Snapshots(t *testing.T) {
+	input := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		snapshots {
+			dir  /var/lib/tarka/snapshots
+			keep 5
+		}
+	}`
+
+	p := new(Provider)
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	if p.Snapshots == nil || p.Snapshots.Dir != "/var/lib/tarka/snapshots" || p.Snapshots.Keep != 5 {
+		t.Errorf("unexpected snapshots config %+v", p.Snapshots)
+	}
+
+	bad := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		snapshots {
+			keep 0
+		}
+	}`
+	if err := new(Provider).UnmarshalCaddyfile(caddyfile.NewTestDispenser(bad)); err == nil {
+		t.Error("expected an error for keep 0")
+	}
+}
+
+func TestUnmarshalCaddyfile_Delegation(t *testing.T) {
+	input := `tarka {
+		username  testuser
+		password  testpass
+		domain_id 123
+		delegate _acme-challenge.example.net example-net.acme.example.com
+		delegate _acme-challenge.example.org example-org.acme.example.com acme.example.com 200
+		follow_cnames 192.0.2.53 [2001:db8::53]:5353
+	}`
+
+	p := new(Provider)
+	if err := p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	want := []Delegation{
+		{Name: "_acme-challenge.example.net", Target: "example-net.acme.example.com"},
+		{Name: "_acme-challenge.example.org", Target: "example-org.acme.example.com", Zone: "acme.example.com", DomainID: "200"},
+	}
+	if !reflect.DeepEqual(p.Delegations, want) {
+		t.Errorf("expected delegations %+v, got %+v", want, p.Delegations)
+	}
+	if p.FollowCNAMEs == nil || len(p.FollowCNAMEs.Resolvers) != 2 {
+		t.Fatalf("unexpected follow_cnames config %+v", p.FollowCNAMEs)
+	}
+
+	ctx, cancel := StandaloneContext(context.Background(), nil)
+	defer cancel()
+	if err := p.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	if got := p.FollowCNAMEs.Resolvers; got[0] != "192.0.2.53:53" || got[1] != "[2001:db8::53]:5353" {
+		t.Errorf("expected resolvers with ports, got %v", got)
+	}
+}
+
 func TestProvision(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -137,6 +450,16 @@ func TestProvision(t *testing.T) {
 			expectedWaitTime: 5 * time.Second,
 			shouldErr:        false,
 		},
+		{
+			name:            "default TTL out of range with reject policy",
+			initialProvider: &Provider{DefaultTTL: 10 * time.Second, TTLPolicy: TTLPolicyReject},
+			shouldErr:       true,
+		},
+		{
+			name:            "delegation with a domain ID but no zone",
+			initialProvider: &Provider{Delegations: []Delegation{{Name: "_acme-challenge.example.net", Target: "example-net.acme.example.com", DomainID: "200"}}},
+			shouldErr:       true,
+		},
 		{
 			name: "user-defined propagation wait time",
 			initialProvider: &Provider{
@@ -150,7 +473,7 @@ func TestProvision(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			p := tc.initialProvider
-			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			ctx, cancel := StandaloneContext(context.Background(), nil)
 			defer cancel()
 
 			err := p.Provision(ctx)
@@ -0,0 +1,95 @@
+package tarka
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// maxNameLength is the longest a domain name may be in presentation form, without the trailing dot
+const maxNameLength = 253
+
+// normalizeZone returns zone in the canonical form we compare zones in:
+// lowercase ASCII with no trailing dot.
+func normalizeZone(zone string) (string, error) {
+	ascii, err := toASCII(strings.TrimSuffix(zone, "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid zone %q: %w", zone, err)
+	}
+	return ascii, nil
+}
+
+// tarkaName converts a record name as a libdns caller may give it into the
+// name the Tarka form expects: relative to the zone, "" for the apex, in
+// lowercase ASCII. Accepted inputs are relative names ("www", "@"), FQDNs
+// with or without the trailing dot ("www.example.com."), and relative names
+// already carrying the zone suffix. Internationalised names are converted to
+// punycode. Names outside the zone are rejected.
+func tarkaName(name, zone string) (string, error) {
+	zone, err := normalizeZone(zone)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == "@" {
+		return "", nil
+	}
+
+	fqdn := strings.HasSuffix(name, ".")
+	ascii, err := toASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid record name %q: %w", name, err)
+	}
+
+	switch {
+	case ascii == zone:
+		return "", nil
+	case zone != "" && strings.HasSuffix(ascii, "."+zone):
+		ascii = strings.TrimSuffix(ascii, "."+zone)
+	case fqdn:
+		return "", fmt.Errorf("record name %q is outside zone %s", name, zone)
+	}
+
+	if len(ascii)+len(zone)+1 > maxNameLength {
+		return "", fmt.Errorf("record name %q is too long", name)
+	}
+	return ascii, nil
+}
+
+// libdnsName converts a name from a Tarka listing into the relative name
+// libdns expects, with "@" for the apex. Listings may show names relative,
+// fully qualified or with the zone suffix; names are returned in ASCII, as
+// DNS carries them, so they compare equal to what Caddy and other callers send.
+func libdnsName(name, zone string) string {
+	relative, err := tarkaName(name, zone)
+	if err != nil {
+		// Leave names we cannot make sense of untouched rather than hiding the record
+		relative = name
+	}
+	if relative == "" {
+		return "@"
+	}
+	return relative
+}
+
+// toASCII lowercases a domain name and converts any internationalised labels
+// to punycode, checking label lengths. Underscores and wildcards are allowed,
+// as record names like _acme-challenge and *.example.com need them.
+func toASCII(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	ascii, err := idna.Punycode.ToASCII(strings.ToLower(name))
+	if err != nil {
+		return "", err
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" {
+			return "", fmt.Errorf("empty label")
+		}
+		if len(label) > 63 {
+			return "", fmt.Errorf("label %q is longer than 63 bytes", label)
+		}
+	}
+	return ascii, nil
+}
@@ -0,0 +1,116 @@
+package tarka
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestTarkaName(t *testing.T) {
+	tests := []struct {
+		name    string
+		zone    string
+		want    string
+		wantErr string
+	}{
+		{name: "@", zone: "example.com.", want: ""},
+		{name: "", zone: "example.com.", want: ""},
+		{name: "www", zone: "example.com.", want: "www"},
+		{name: "_acme-challenge.app", zone: "example.com", want: "_acme-challenge.app"},
+		{name: "WWW", zone: "Example.COM.", want: "www"},
+		{name: "www.example.com.", zone: "example.com.", want: "www"},
+		{name: "www.example.com", zone: "example.com.", want: "www"},
+		{name: "example.com.", zone: "example.com.", want: ""},
+		{name: "*.example.com.", zone: "example.com", want: "*"},
+		{name: "bücher", zone: "example.com.", want: "xn--bcher-kva"},
+		{name: "www.bücher.de.", zone: "bücher.de.", want: "www"},
+		{name: "www", zone: "xn--bcher-kva.de.", want: "www"},
+		{name: "www.example.net.", zone: "example.com.", wantErr: "outside zone"},
+		{name: "a..b", zone: "example.com.", wantErr: "empty label"},
+		{name: strings.Repeat("a", 64), zone: "example.com.", wantErr: "longer than 63"},
+		{name: strings.Repeat("abcdefgh.", 30) + "x", zone: "example.com.", wantErr: "too long"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name+"/"+tc.zone, func(t *testing.T) {
+			got, err := tarkaName(tc.name, tc.zone)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %q, %v", tc.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect an error but got: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLibdnsName(t *testing.T) {
+	tests := []struct{ name, zone, want string }{
+		{"", "example.com.", "@"},
+		{"@", "example.com.", "@"},
+		{"www", "example.com.", "www"},
+		{"www.example.com.", "example.com.", "www"},
+		{"example.com", "example.com.", "@"},
+		{"xn--bcher-kva", "example.com.", "xn--bcher-kva"},
+		{"stray.example.net.", "example.com.", "stray.example.net."},
+	}
+
+	for _, tc := range tests {
+		if got := libdnsName(tc.name, tc.zone); got != tc.want {
+			t.Errorf("libdnsName(%q, %q): expected %q, got %q", tc.name, tc.zone, tc.want, got)
+		}
+	}
+}
+
+func TestProvider_NormalizesNames(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	// A record as Tarka might list it, fully qualified
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www.example.com.", Type: "A", Data: "192.0.2.1"})
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+
+	_, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge.example.com.", Text: "token"},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	stored := server.Records("123")
+	if stored[1].Name != "_acme-challenge" {
+		t.Errorf("expected the name to be sent relative to the zone, got %q", stored[1].Name)
+	}
+
+	records, err := p.GetRecords(ctx, "example.com.")
+	if err != nil {
+		t.Fatalf("GetRecords failed: %v", err)
+	}
+	if name := records[0].RR().Name; name != "www" {
+		t.Errorf("expected the listed name to be made relative, got %q", name)
+	}
+
+	// Deleting by relative name matches the fully qualified listing
+	p.DeleteUnowned = true
+	deleted, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{libdns.RR{Name: "www", Type: "A"}})
+	if err != nil || len(deleted) != 1 {
+		t.Errorf("expected 1 record deleted, got %d, err %v", len(deleted), err)
+	}
+
+	_, err = p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge.example.net.", Text: "token"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "outside zone") {
+		t.Errorf("expected a name outside the zone to be rejected, got: %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package tarka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+// Change actions in a Plan
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Change is one step of a Plan
+type Change struct {
+	// Action is ActionAdd, ActionUpdate or ActionDelete
+	Action string
+
+	// Before is the existing record, for updates and deletes
+	Before client.Record
+
+	// After is the desired record, for adds and updates
+	After client.Record
+}
+
+// Plan is a set of changes that brings a zone in Tarka to a desired state,
+// computed up front so it can be reviewed before it is applied
+type Plan struct {
+	Zone     string
+	DomainID string
+
+	// Changes, in the order they are applied: updates, then adds, then deletes
+	Changes []Change
+
+	// Unsupported lists desired records Tarka can't hold, which the plan leaves out
+	Unsupported []string
+}
+
+// Empty reports whether the plan changes nothing
+func (pl *Plan) Empty() bool {
+	return len(pl.Changes) == 0
+}
+
+// Count returns how many changes of an action the plan has
+func (pl *Plan) Count(action string) int {
+	n := 0
+	for _, change := range pl.Changes {
+		if change.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteTo writes the plan in a form for people to review
+func (pl *Plan) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	if len(pl.Unsupported) > 0 {
+		fmt.Fprintf(&sb, "Unsupported records, which will be skipped:\n")
+		for _, rec := range pl.Unsupported {
+			fmt.Fprintf(&sb, "  ! %s\n", rec)
+		}
+	}
+	fmt.Fprintf(&sb, "Plan for %s (Tarka domain %s): %d to add, %d to update, %d to delete\n",
+		pl.Zone, pl.DomainID, pl.Count(ActionAdd), pl.Count(ActionUpdate), pl.Count(ActionDelete))
+	for _, change := range pl.Changes {
+		switch change.Action {
+		case ActionAdd:
+			fmt.Fprintf(&sb, "  + %s\n", planRecord(change.After, pl.Zone))
+		case ActionUpdate:
+			fmt.Fprintf(&sb, "  ~ %s -> %d %s\n", planRecord(change.Before, pl.Zone), change.After.TTL, change.After.Data)
+		case ActionDelete:
+			fmt.Fprintf(&sb, "  - %s\n", planRecord(change.Before, pl.Zone))
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func planRecord(rec client.Record, zone string) string {
+	return fmt.Sprintf("%s %d %s %s", libdnsName(rec.Name, zone), rec.TTL, rec.Type, rec.Data)
+}
+
+// diffRecords plans the changes that turn existing into desired, RRset by
+// RRset. Existing records already holding desired data are kept, with their
+// TTL updated if it differs; other existing records of the RRset are edited
+// in place before anything is added or deleted. RRsets that aren't in
+// desired at all are deleted only if prune is set.
+func diffRecords(existing, desired []client.Record, prune bool) []Change {
+	type rrsetKey struct{ name, recordType string }
+	have := make(map[rrsetKey][]client.Record)
+	want := make(map[rrsetKey][]client.Record)
+	seen := make(map[rrsetKey]bool)
+	var keys []rrsetKey
+	for _, rec := range existing {
+		key := rrsetKey{rec.Name, rec.Type}
+		have[key] = append(have[key], rec)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, rec := range desired {
+		key := rrsetKey{rec.Name, rec.Type}
+		want[key] = append(want[key], rec)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].recordType < keys[j].recordType
+	})
+
+	var updates, adds, deletes []Change
+	for _, key := range keys {
+		wanted, ok := want[key]
+		if !ok && !prune {
+			continue
+		}
+		used := make([]bool, len(have[key]))
+		var unmatched []client.Record
+
+		// Keep records whose data is already right
+		for _, w := range wanted {
+			matched := false
+			for j, h := range have[key] {
+				if used[j] || canonicalData(h) != canonicalData(w) {
+					continue
+				}
+				used[j], matched = true, true
+				if h.TTL != w.TTL {
+					// Keep the expiry, which a blank field would clear
+					w.ID, w.Expires = h.ID, h.Expires
+					updates = append(updates, Change{Action: ActionUpdate, Before: h, After: w})
+				}
+				break
+			}
+			if !matched {
+				unmatched = append(unmatched, w)
+			}
+		}
+
+		// Edit the remaining existing records, then add or delete what's left
+		for _, w := range unmatched {
+			edited := false
+			for j, h := range have[key] {
+				if used[j] {
+					continue
+				}
+				used[j], edited = true, true
+				w.ID, w.Expires = h.ID, h.Expires
+				updates = append(updates, Change{Action: ActionUpdate, Before: h, After: w})
+				break
+			}
+			if !edited {
+				adds = append(adds, Change{Action: ActionAdd, After: w})
+			}
+		}
+		for j, h := range have[key] {
+			if !used[j] {
+				deletes = append(deletes, Change{Action: ActionDelete, Before: h})
+			}
+		}
+	}
+	return append(append(updates, adds...), deletes...)
+}
+
+// canonicalData returns record data in a form that compares equal however
+// Tarka or a zone file happened to write it: TXT text decoded, and host
+// names lowercased without a trailing dot
+func canonicalData(rec client.Record) string {
+	switch rec.Type {
+	case "TXT":
+		if text, err := client.DecodeTXT(rec.Data); err == nil {
+			return text
+		}
+	case "CNAME", "NS", "PTR", "MX", "SRV":
+		return hostData(rec.Data)
+	}
+	return rec.Data
+}
+
+// hostData returns the data of a record whose last field is a host name in
+// the form Tarka stores it: lowercase, without the trailing dot
+func hostData(data string) string {
+	fields := strings.Fields(data)
+	if len(fields) > 0 {
+		last := len(fields) - 1
+		fields[last] = strings.ToLower(strings.TrimSuffix(fields[last], "."))
+	}
+	return strings.Join(fields, " ")
+}
+
+// ApplyPlan makes the changes of a plan, holding the zone's lock throughout
+// and taking a snapshot first if snapshots are on. It stops at the first
+// change that fails, so on error the zone may be partially changed.
+func (p *Provider) ApplyPlan(ctx context.Context, plan *Plan) (err error) {
+	ctx, span := p.startSpan(ctx, "ApplyPlan", plan.Zone, nil)
+	defer func() { endSpan(span, err) }()
+
+	c, err := p.getClient()
+	if err != nil {
+		return err
+	}
+	unlock, err := p.lockZone(ctx, c.BaseURL(), plan.DomainID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if p.snapshots != nil {
+		listed, err := p.listRecords(ctx, c, plan.Zone, plan.DomainID)
+		if err != nil {
+			return err
+		}
+		if err := p.snapshotZone(ctx, plan.Zone, plan.DomainID, listed); err != nil {
+			return err
+		}
+	}
+
+	for _, change := range plan.Changes {
+		switch change.Action {
+		case ActionAdd:
+			rec := change.After
+			rec.Expires = recordExpiry(rec, challengeCertificate(rec.Name, plan.Zone))
+			p.log.Info("Adding record", zap.String("name", rec.Name), zap.String("type", rec.Type), zap.String("domain_id", plan.DomainID))
+			created, err := c.AddRecord(ctx, plan.DomainID, rec)
+			p.countChange("add", rec.Type, err)
+			p.audit(ctx, plan.Zone, plan.DomainID, nil, added(created, rec, err), err)
+			if err != nil {
+				return err
+			}
+			p.recordCreated(ctx, plan.Zone, plan.DomainID, created, challengeCertificate(created.Name, plan.Zone))
+		case ActionUpdate:
+			rec := change.After
+			if rec.Expires.IsZero() {
+				rec.Expires = recordExpiry(rec, challengeCertificate(rec.Name, plan.Zone))
+			}
+			p.log.Info("Updating record", zap.String("name", rec.Name), zap.String("type", rec.Type), zap.String("id", rec.ID))
+			err := c.UpdateRecord(ctx, plan.DomainID, rec)
+			p.countChange("update", rec.Type, err)
+			p.audit(ctx, plan.Zone, plan.DomainID, &change.Before, &rec, err)
+			if err != nil {
+				return err
+			}
+		case ActionDelete:
+			rec := change.Before
+			p.log.Info("Deleting record", zap.String("name", rec.Name), zap.String("type", rec.Type), zap.String("id", rec.ID))
+			err := c.DeleteRecord(ctx, plan.DomainID, rec.ID)
+			p.countChange("delete", rec.Type, err)
+			p.audit(ctx, plan.Zone, plan.DomainID, &rec, nil, err)
+			if err != nil {
+				return err
+			}
+			p.recordDeleted(ctx, plan.DomainID, rec.ID)
+		default:
+			return fmt.Errorf("unknown plan action %q", change.Action)
+		}
+	}
+	return nil
+}
@@ -3,10 +3,13 @@ package tarka
 import (
 	"context"
 	"fmt"
-	"net/http"
+	"sync"
 	"time"
 
+	"github.com/caddyserver/certmagic"
 	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/client"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -18,7 +21,8 @@ type Provider struct {
 	// Password for Tarka DNS login
 	Password string `json:"password,omitempty"`
 
-	// DomainID is the numeric domain ID for your zone in Tarka DNS
+	// DomainID is the numeric domain ID for your zone in Tarka DNS. Other
+	// zones, or all of them if empty, are looked up by name.
 	DomainID string `json:"domain_id,omitempty"`
 
 	// BaseURL is the base URL for Tarka DNS (defaults to https://tarka.cloud/custdata)
@@ -27,44 +31,176 @@ type Provider struct {
 	// Delay to wait for DNS records to apply
 	PropogationWaitTime time.Duration `json:"propogation_wait_time,omitempty"`
 
-	// httpClient for making requests
-	httpClient *http.Client
+	// DefaultTTL is used for records created without a TTL (defaults to Tarka's own default of 1h)
+	DefaultTTL time.Duration `json:"default_ttl,omitempty"`
+
+	// TTLPolicy decides what happens to TTLs outside the range Tarka accepts:
+	// "clamp" them to the nearest limit (the default) or "reject" the record
+	TTLPolicy string `json:"ttl_policy,omitempty"`
+
+	// How long a validated session is trusted before checking it again (defaults to 5m)
+	SessionCheckInterval time.Duration `json:"session_check_interval,omitempty"`
+
+	// Transport customises the HTTP client used for requests to Tarka
+	Transport *client.TransportConfig `json:"transport,omitempty"`
+
+	// Sweeper, if set, periodically removes stale ACME challenge records
+	// that this provider created
+	Sweeper *SweeperConfig `json:"sweeper,omitempty"`
+
+	// DeleteUnowned lets DeleteRecords remove records this provider did not
+	// create. By default only records in the ledger are deleted, so records
+	// managed by hand in the web UI are left alone.
+	DeleteUnowned bool `json:"delete_unowned,omitempty"`
+
+	// DryRun makes the provider log the record changes it would make rather
+	// than making them. It still logs in and reads records, and returns the
+	// records it would have changed, marked in their ProviderData.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Tracing, if set, exports OpenTelemetry spans for provider calls
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+
+	// Delegations send TXT records for names hosted elsewhere, such as
+	// _acme-challenge.example.net, to the names in Tarka they are CNAMEs to
+	Delegations []Delegation `json:"delegations,omitempty"`
+
+	// FollowCNAMEs, if set, looks up CNAMEs of names given TXT records and
+	// sends the records to where the chain ends in Tarka, so delegations
+	// don't have to be listed one by one
+	FollowCNAMEs *CNAMEFollowing `json:"follow_cnames,omitempty"`
+
+	// Snapshots, if set, saves each zone before SetRecords changes it
+	Snapshots *SnapshotConfig `json:"snapshots,omitempty"`
+
+	// Audit, if set, records every change sent to Tarka
+	Audit *AuditConfig `json:"audit,omitempty"`
+
+	// How long to wait for another instance sharing Caddy's storage to
+	// finish changing a zone before giving up (defaults to 1m)
+	LockTimeout time.Duration `json:"lock_timeout,omitempty"`
+
+	// ledger of records this provider created
+	ledger ledger
+
+	// storage shared with other Caddy instances, used for zone locks
+	storage certmagic.Storage
+
+	// snapshots store, nil when snapshots are off
+	snapshots *snapshotStore
+
+	// auditSink changes are recorded in, nil when auditing is off
+	auditSink auditSink
+
+	// instanceID of the Caddy instance, for audit events
+	instanceID string
+
+	// metrics registered with Caddy, nil outside Caddy
+	metrics *metrics
+
+	// tracerProvider for spans, nil when tracing is off
+	tracerProvider trace.TracerProvider
+
+	// shutdownTracing flushes and stops the tracer provider we created
+	shutdownTracing func(context.Context) error
+
+	// client for the Tarka web UI, created on first use
+	client *client.Client
+
+	// domainZone is the zone name of DomainID, looked up on first use
+	domainZone string
+
+	// mu guards client and domainZone
+	mu sync.Mutex
 
 	// logging module via Caddy
 	log *zap.Logger
 }
 
-// GetRecords lists DNS records in the zone. This is a no-op for our use case.
-func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
-	// Not implemented - return empty slice
-	// If you needed to implement this, you would:
-	// 1. Make API call to list records
-	// 2. Convert each record to libdns.RR
-	// 3. Return them wrapped as Records
-	return []libdns.Record{}, nil
+// acmeChallengeExpiry is how long ACME challenge records live before Tarka removes them
+const acmeChallengeExpiry = 10 * time.Minute
+
+// recordExpiry returns when Tarka should remove a record we create. ACME
+// challenge TXT records, those with the certificate they validate, auto-expire;
+// everything else is permanent.
+func recordExpiry(rec client.Record, certificate string) time.Time {
+	if rec.Type == "TXT" && certificate != "" {
+		return time.Now().Add(acmeChallengeExpiry)
+	}
+	return time.Time{}
+}
+
+// GetRecords lists DNS records in the zone.
+func (p *Provider) GetRecords(ctx context.Context, zone string) (_ []libdns.Record, err error) {
+	ctx, span := p.startSpan(ctx, "GetRecords", zone, nil)
+	defer func() { endSpan(span, err) }()
+
+	c, domainID, err := p.zoneClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	listed, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]libdns.Record, 0, len(listed))
+	for _, rec := range listed {
+		records = append(records, fromTarkaRecord(rec, zone, domainID))
+	}
+	return records, nil
+}
+
+// AppendRecords adds DNS records to the zone. TXT records for delegated
+// names are added to the Tarka zone they are delegated to instead.
+func (p *Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) (_ []libdns.Record, err error) {
+	ctx, span := p.startSpan(ctx, "AppendRecords", zone, records)
+	defer func() { endSpan(span, err) }()
+
+	return p.forEachZone(ctx, zone, records, p.appendRecords)
 }
 
-// AppendRecords adds DNS records to the zone.
-func (p *Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	if err := p.ensureAuthenticated(ctx); err != nil {
-		return nil, fmt.Errorf("authentication failed: %w", err)
+// appendRecords adds records to a domain, holding its lock
+func (p *Provider) appendRecords(ctx context.Context, c *client.Client, zone, domainID string, records []libdns.Record, certificates map[string]string) ([]libdns.Record, error) {
+	unlock, err := p.lockZone(ctx, c.BaseURL(), domainID)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
 	var appendedRecords []libdns.Record
 
 	for _, record := range records {
 		rr := record.RR()
 
-		if rr.Type != "TXT" {
-			return nil, fmt.Errorf("only TXT records are supported, got %s", rr.Type)
+		if !client.IsSupportedType(rr.Type) {
+			return nil, fmt.Errorf("unsupported record type %s", rr.Type)
+		}
+
+		rec, err := toTarkaRecord(record, zone, domainID)
+		if err != nil {
+			return nil, err
+		}
+		if rec.TTL, err = p.effectiveTTL(rr.TTL); err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", rr.Name, err)
+		}
+		certificate, ok := certificates[rec.Name]
+		if !ok {
+			certificate = challengeCertificate(rec.Name, zone)
 		}
+		rec.Expires = recordExpiry(rec, certificate)
 
-		err := p.addTXTRecord(ctx, rr.Name, rr.Data, rr.TTL)
+		p.log.Info("Adding record", zap.String("name", rec.Name), zap.String("type", rec.Type), zap.String("domain_id", domainID))
+		created, err := c.AddRecord(ctx, domainID, rec)
+		p.countChange("add", rec.Type, err)
+		p.audit(ctx, zone, domainID, nil, added(created, rec, err), err)
 		if err != nil {
 			return nil, fmt.Errorf("failed to add record %s: %w", rr.Name, err)
 		}
+		p.recordCreated(ctx, zone, domainID, created, certificate)
 
-		appendedRecords = append(appendedRecords, record)
+		appendedRecords = append(appendedRecords, p.changedRecord(created, zone, domainID))
 		// It seems that the HTTP endpoint has a short delay before DNS records are actually active.
 		//
 	}
@@ -72,22 +208,291 @@ func (p *Provider) AppendRecords(ctx context.Context, zone string, records []lib
 	return appendedRecords, nil
 }
 
-// SetRecords sets DNS records in the zone. For our use case, this is the same as AppendRecords.
-func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	return p.AppendRecords(ctx, zone, records)
+// SetRecords sets DNS records in the zone, so that for each name and type in
+// the input, the input records are the only records of that name and type.
+// Existing records are changed in place where possible, so the name keeps
+// resolving throughout; surplus records are added first and removed last.
+// This is not atomic: on error, the zone may be partially updated. Unlike
+// DeleteRecords, SetRecords replaces RRsets regardless of who created them.
+func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) (_ []libdns.Record, err error) {
+	ctx, span := p.startSpan(ctx, "SetRecords", zone, records)
+	defer func() { endSpan(span, err) }()
+
+	c, domainID, err := p.zoneClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := p.lockZone(ctx, c.BaseURL(), domainID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Group the input into RRsets, keeping input order
+	type rrsetKey struct{ name, recordType string }
+	var keys []rrsetKey
+	desired := make(map[rrsetKey][]client.Record)
+	for _, record := range records {
+		rr := record.RR()
+		if !client.IsSupportedType(rr.Type) {
+			return nil, fmt.Errorf("unsupported record type %s", rr.Type)
+		}
+		rec, err := toTarkaRecord(record, zone, domainID)
+		if err != nil {
+			return nil, err
+		}
+		if rec.TTL, err = p.effectiveTTL(rr.TTL); err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", rr.Name, err)
+		}
+		key := rrsetKey{rec.Name, rec.Type}
+		if _, ok := desired[key]; !ok {
+			keys = append(keys, key)
+		}
+		desired[key] = append(desired[key], rec)
+	}
+
+	listed, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.snapshotZone(ctx, zone, domainID, listed); err != nil {
+		return nil, err
+	}
+	existing := make(map[rrsetKey][]client.Record)
+	for _, rec := range listed {
+		key := rrsetKey{rec.Name, rec.Type}
+		existing[key] = append(existing[key], rec)
+	}
+
+	var setRecords []libdns.Record
+	for _, key := range keys {
+		set, err := p.setRRset(ctx, c, zone, domainID, existing[key], desired[key])
+		if err != nil {
+			return nil, fmt.Errorf("failed to set %s records for %s: %w", key.recordType, key.name, err)
+		}
+		setRecords = append(setRecords, set...)
+	}
+	return setRecords, nil
 }
 
-// DeleteRecords deletes DNS records from the zone. This is a no-op since we rely on auto-expiry.
-func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	// Not implemented - rely on auto-expiry
-	// Return the records as if they were deleted
+// setRRset makes the existing members of one RRset match the desired ones.
+// Desired records carrying a Tarka ID are applied to that row, records
+// already holding desired data are kept (with their TTL updated if needed),
+// other existing records are edited to take the remaining desired data, and
+// only then are leftover records added or deleted.
+func (p *Provider) setRRset(ctx context.Context, c *client.Client, zone, domainID string, existing, desired []client.Record) ([]libdns.Record, error) {
+	results := make([]client.Record, len(desired))
+	done := make([]bool, len(desired))
+	used := make([]bool, len(existing))
+
+	// Apply records that name their row by ID
+	for i, want := range desired {
+		if want.ID == "" {
+			continue
+		}
+		for j, have := range existing {
+			if used[j] || have.ID != want.ID {
+				continue
+			}
+			used[j], done[i] = true, true
+			results[i] = have
+			if canonicalData(have) != canonicalData(want) || have.TTL != want.TTL {
+				have.Data, have.TTL = want.Data, want.TTL
+				p.log.Info("Updating record", zap.String("name", have.Name), zap.String("type", have.Type), zap.String("id", have.ID))
+				err := c.UpdateRecord(ctx, domainID, have)
+				p.countChange("update", have.Type, err)
+				p.audit(ctx, zone, domainID, &existing[j], &have, err)
+				if err != nil {
+					return nil, err
+				}
+				results[i] = have
+			}
+			break
+		}
+	}
+
+	// Keep records whose data is already right
+	for i, want := range desired {
+		if done[i] {
+			continue
+		}
+		for j, have := range existing {
+			if used[j] || canonicalData(have) != canonicalData(want) {
+				continue
+			}
+			used[j], done[i] = true, true
+			results[i] = have
+			if have.TTL != want.TTL {
+				have.TTL = want.TTL
+				p.log.Info("Updating record TTL", zap.String("name", have.Name), zap.String("type", have.Type), zap.String("id", have.ID))
+				err := c.UpdateRecord(ctx, domainID, have)
+				p.countChange("update", have.Type, err)
+				p.audit(ctx, zone, domainID, &existing[j], &have, err)
+				if err != nil {
+					return nil, err
+				}
+				results[i] = have
+			}
+			break
+		}
+	}
+
+	// Edit the remaining existing records in place to hold the remaining data
+	for i, want := range desired {
+		if done[i] {
+			continue
+		}
+		for j, have := range existing {
+			if used[j] {
+				continue
+			}
+			used[j], done[i] = true, true
+			want.ID = have.ID
+			want.Expires = recordExpiry(want, challengeCertificate(want.Name, zone))
+			p.log.Info("Updating record", zap.String("name", want.Name), zap.String("type", want.Type), zap.String("id", want.ID))
+			err := c.UpdateRecord(ctx, domainID, want)
+			p.countChange("update", want.Type, err)
+			p.audit(ctx, zone, domainID, &have, &want, err)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = want
+			break
+		}
+	}
+
+	// Add what could not be done by editing
+	for i, want := range desired {
+		if done[i] {
+			continue
+		}
+		want.Expires = recordExpiry(want, challengeCertificate(want.Name, zone))
+		p.log.Info("Adding record", zap.String("name", want.Name), zap.String("type", want.Type), zap.String("domain_id", domainID))
+		created, err := c.AddRecord(ctx, domainID, want)
+		p.countChange("add", want.Type, err)
+		p.audit(ctx, zone, domainID, nil, added(created, want, err), err)
+		if err != nil {
+			return nil, err
+		}
+		p.recordCreated(ctx, zone, domainID, created, challengeCertificate(created.Name, zone))
+		results[i] = created
+	}
+
+	// Finally remove records no longer wanted
+	for j, have := range existing {
+		if used[j] {
+			continue
+		}
+		p.log.Info("Deleting record", zap.String("name", have.Name), zap.String("type", have.Type), zap.String("id", have.ID))
+		err := c.DeleteRecord(ctx, domainID, have.ID)
+		p.countChange("delete", have.Type, err)
+		p.audit(ctx, zone, domainID, &have, nil, err)
+		if err != nil {
+			return nil, err
+		}
+		p.recordDeleted(ctx, domainID, have.ID)
+	}
+
+	records := make([]libdns.Record, 0, len(results))
+	for _, rec := range results {
+		records = append(records, p.changedRecord(rec, zone, domainID))
+	}
 	return records, nil
 }
 
-// GetZones lists all zones available. This is a no-op for our use case.
+// DeleteRecords deletes DNS records from the zone. Records carrying
+// ProviderData are deleted by their Tarka ID; others are matched against the
+// zone by name and, where given, type, TTL and data. Unless DeleteUnowned is
+// set, records missing from the ledger are skipped rather than deleted. TXT
+// records for delegated names are deleted from the zone they were added to.
+func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) (_ []libdns.Record, err error) {
+	ctx, span := p.startSpan(ctx, "DeleteRecords", zone, records)
+	defer func() { endSpan(span, err) }()
+
+	return p.forEachZone(ctx, zone, records, p.deleteRecords)
+}
+
+// deleteRecords deletes records from a domain, holding its lock
+func (p *Provider) deleteRecords(ctx context.Context, c *client.Client, zone, domainID string, records []libdns.Record, _ map[string]string) ([]libdns.Record, error) {
+	unlock, err := p.lockZone(ctx, c.BaseURL(), domainID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	listed, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	var deletedRecords []libdns.Record
+	deleted := make(map[string]bool)
+	for _, record := range records {
+		want, err := toTarkaRecord(record, zone, domainID)
+		if err != nil {
+			return deletedRecords, err
+		}
+		for _, have := range listed {
+			if deleted[have.ID] || !matchesForDelete(have, want) {
+				continue
+			}
+			if !p.DeleteUnowned && !p.ledger.owns(ctx, domainID, have.ID) {
+				p.log.Info("Skipping record not created by this provider", zap.String("name", have.Name), zap.String("type", have.Type), zap.String("id", have.ID))
+				continue
+			}
+			p.log.Info("Deleting record", zap.String("name", have.Name), zap.String("type", have.Type), zap.String("id", have.ID))
+			err := c.DeleteRecord(ctx, domainID, have.ID)
+			p.countChange("delete", have.Type, err)
+			p.audit(ctx, zone, domainID, &have, nil, err)
+			if err != nil {
+				return deletedRecords, fmt.Errorf("failed to delete record %s: %w", record.RR().Name, err)
+			}
+			p.recordDeleted(ctx, domainID, have.ID)
+			deleted[have.ID] = true
+			deletedRecords = append(deletedRecords, p.changedRecord(have, zone, domainID))
+		}
+	}
+	return deletedRecords, nil
+}
+
+// matchesForDelete reports whether a listed record is selected for deletion
+// by want. A want with an ID selects exactly that record; otherwise the name
+// must match, and type, TTL and data must match unless left empty.
+func matchesForDelete(have, want client.Record) bool {
+	if want.ID != "" {
+		return have.ID == want.ID
+	}
+	if have.ID == "" || have.Name != want.Name {
+		return false
+	}
+	if want.Type != "" && have.Type != want.Type {
+		return false
+	}
+	if want.TTL != 0 && have.TTL != want.TTL {
+		return false
+	}
+	if want.Data != "" && canonicalData(have) != canonicalData(want) {
+		return false
+	}
+	return true
+}
+
+// GetZones lists all zones available in the Tarka account.
 func (p *Provider) GetZones(ctx context.Context) ([]libdns.Zone, error) {
-	// Not implemented - return empty slice
-	return []libdns.Zone{}, nil
+	c, err := p.getClient()
+	if err != nil {
+		return nil, err
+	}
+	domains, err := c.ListDomains(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	zones := make([]libdns.Zone, 0, len(domains))
+	for _, domain := range domains {
+		zones = append(zones, libdns.Zone{Name: domain.Name + "."})
+	}
+	return zones, nil
 }
 
 // Interface guards
@@ -3,20 +3,28 @@ package tarka
 import (
 	"context"
 	"fmt"
+	"html"
 	"net/http"
-	"net/http/cookiejar"
 	"net/http/httptest"
-	"net/url"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
 	"go.uber.org/zap"
 )
 
 // mockServer creates a httptest.Server to mock the Tarka API.
 func mockServer() *httptest.Server {
+	return httptest.NewServer(mockMux())
+}
+
+// mockMux returns the handlers behind mockServer, so tests can wrap them.
+func mockMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	// Mock login
@@ -48,7 +56,7 @@ func mockServer() *httptest.Server {
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "Customer view page")
+		fmt.Fprintln(w, `Customer view page <a href="domain-view.php?domain_id=123">example.com</a>`)
 	})
 
 	// Mock record creation
@@ -60,15 +68,19 @@ func mockServer() *httptest.Server {
 		}
 
 		if r.FormValue("do_add") == "1" && r.FormValue("rr_type_id") == "8" {
+			// Like Tarka, show the domain's records after the change
 			w.WriteHeader(http.StatusOK)
-			fmt.Fprintln(w, "Record added")
+			fmt.Fprintln(w, "<table><tr><th>Name</th><th>Type</th><th>Data</th></tr>")
+			fmt.Fprintf(w, `<tr><td>%s</td><td>TXT</td><td>%s</td><td><a href="domain-rr-edit.php?rr_id=1000">edit</a></td></tr>`+"\n",
+				html.EscapeString(r.FormValue("name")), html.EscapeString(r.FormValue("data")))
+			fmt.Fprintln(w, "</table>")
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintln(w, "Bad request")
 		}
 	})
 
-	return httptest.NewServer(mux)
+	return mux
 }
 
 func newTestProvider(serverURL string) *Provider {
@@ -131,40 +143,416 @@ func TestProvider_AppendRecords_AuthFailure(t *testing.T) {
 	}
 }
 
-func TestProvider_isSessionValid(t *testing.T) {
-	server := mockServer()
+func TestProvider_AppendRecords_RetriesAfterSessionExpiry(t *testing.T) {
+	var logins, adds atomic.Int32
+	mux := mockMux()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/custdata/login.php":
+			if r.Method == "POST" {
+				logins.Add(1)
+			}
+		case "/custdata/domain-rr-edit.php":
+			// Expire the session on the first mutation by bouncing to the login page
+			if adds.Add(1) == 1 {
+				http.Redirect(w, r, "/custdata/login.php", http.StatusFound)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	p := newTestProvider(server.URL)
+	records := []libdns.Record{
+		libdns.RR{Type: "TXT", Name: "_acme-challenge", Data: "test-token"},
+	}
+
+	if _, err := p.AppendRecords(context.Background(), "example.com", records); err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if logins.Load() != 2 {
+		t.Errorf("expected a re-login after session expiry, got %d logins", logins.Load())
+	}
+	if adds.Load() != 2 {
+		t.Errorf("expected the record creation to be retried once, got %d attempts", adds.Load())
+	}
+}
+
+func TestProvider_GetRecords(t *testing.T) {
+	server := tarkatest.NewServer()
 	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "_acme-challenge", Type: "TXT", Data: "token"})
 
-	// Test case 1: Valid session
-	t.Run("valid session", func(t *testing.T) {
-		p := newTestProvider(server.URL)
-		err := p.login(context.Background())
-		if err != nil {
-			t.Fatalf("login failed: %v", err)
+	p := newTestProvider(server.URL)
+	records, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatalf("GetRecords failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	addr, ok := records[0].(libdns.Address)
+	if !ok {
+		t.Fatalf("expected an A record to be returned as libdns.Address, got %T", records[0])
+	}
+	if addr.Name != "@" || addr.IP.String() != "192.0.2.1" || addr.TTL != time.Hour {
+		t.Errorf("unexpected A record %+v", addr)
+	}
+	if txt, ok := records[1].(libdns.TXT); !ok || txt.Name != "_acme-challenge" || txt.Text != "token" {
+		t.Errorf("unexpected TXT record %#v", records[1])
+	}
+}
+
+func TestProvider_ResolvesDomainIDFromZone(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddDomain("456", "example.net")
+
+	p := newTestProvider(server.URL)
+	p.DomainID = ""
+
+	zones, err := p.GetZones(context.Background())
+	if err != nil {
+		t.Fatalf("GetZones failed: %v", err)
+	}
+	if len(zones) != 2 || zones[0].Name != "example.com." || zones[1].Name != "example.net." {
+		t.Errorf("unexpected zones %+v", zones)
+	}
+
+	records := []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}}
+	if _, err := p.AppendRecords(context.Background(), "example.net.", records); err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if stored := server.Records("456"); len(stored) != 1 || stored[0].Data != "token" {
+		t.Errorf("expected the record in domain 456, got %+v", stored)
+	}
+
+	if _, err := p.AppendRecords(context.Background(), "example.org.", records); err == nil {
+		t.Error("expected an error for a zone not in the account")
+	}
+}
+
+func TestProvider_DomainIDOnlyForItsZone(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddDomain("456", "example.net")
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+	records := []libdns.Record{libdns.TXT{Name: "_acme-challenge", Text: "token"}}
+	for _, zone := range []string{"example.com.", "example.net."} {
+		if _, err := p.AppendRecords(ctx, zone, records); err != nil {
+			t.Fatalf("AppendRecords to %s failed: %v", zone, err)
 		}
-		if !p.isSessionValid(context.Background()) {
-			t.Error("expected session to be valid, but it was invalid")
+	}
+	if len(server.Records("123")) != 1 || len(server.Records("456")) != 1 {
+		t.Errorf("expected a record in each domain, got %+v and %+v", server.Records("123"), server.Records("456"))
+	}
+}
+
+func TestProvider_SetRecords(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	first := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "", Type: "A", TTL: 3600, Data: "192.0.2.2"})
+	txt := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "", Type: "TXT", TTL: 3600, Data: "hello world"})
+	www := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.10"})
+
+	p := newTestProvider(server.URL)
+	input := []libdns.Record{
+		libdns.RR{Name: "@", Type: "A", TTL: time.Hour, Data: "192.0.2.3"},
+		libdns.RR{Name: "www", Type: "A", TTL: 5 * time.Minute, Data: "192.0.2.10"},
+		libdns.RR{Name: "www", Type: "AAAA", TTL: 5 * time.Minute, Data: "2001:db8::1"},
+	}
+	set, err := p.SetRecords(context.Background(), "example.com.", input)
+	if err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+	if len(set) != len(input) {
+		t.Fatalf("expected %d records set, got %d", len(input), len(set))
+	}
+
+	stored := make(map[int]tarkatest.Record)
+	for _, rec := range server.Records("123") {
+		stored[rec.ID] = rec
+	}
+	if len(stored) != 4 {
+		t.Fatalf("expected 4 records in the zone, got %+v", stored)
+	}
+	// The apex A RRset is edited in place rather than deleted and re-added
+	if rec, ok := stored[first]; !ok || rec.Data != "192.0.2.3" {
+		t.Errorf("expected record %d to be updated in place to 192.0.2.3, got %+v", first, rec)
+	}
+	// Records of other types are not affected
+	if rec, ok := stored[txt]; !ok || rec.Data != "hello world" {
+		t.Errorf("expected TXT record %d to be untouched, got %+v", txt, rec)
+	}
+	// A TTL-only change keeps the record
+	if rec, ok := stored[www]; !ok || rec.TTL != 300 {
+		t.Errorf("expected record %d to keep its ID with TTL 300, got %+v", www, rec)
+	}
+	var aaaa int
+	for _, rec := range stored {
+		if rec.Type == "AAAA" && rec.Name == "www" && rec.Data == "2001:db8::1" && rec.Expires.IsZero() {
+			aaaa++
 		}
+	}
+	if aaaa != 1 {
+		t.Errorf("expected the new AAAA record to be added without expiry, got %+v", stored)
+	}
+
+	if _, ok := set[0].(libdns.Address); !ok {
+		t.Errorf("expected set records to be returned as typed records, got %T", set[0])
+	}
+}
+
+func TestProvider_ProviderData(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	// A hand-made record with the same name and value as the one we create
+	manual := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "_acme-challenge", Type: "TXT", Data: "token"})
+
+	ctx := context.Background()
+	p := newTestProvider(server.URL)
+	appended, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token"},
 	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
 
-	// Test case 2: Invalid session (bad cookie)
-	t.Run("invalid session with bad cookie", func(t *testing.T) {
-		p := newTestProvider(server.URL)
-		jar, _ := cookiejar.New(nil)
-		u, _ := url.Parse(p.BaseURL)
-		jar.SetCookies(u, []*http.Cookie{{Name: "tarka_netcraft_com_au-auth-cookie-2", Value: "invalid-cookie"}})
-		p.httpClient = &http.Client{Jar: jar}
+	txt, ok := appended[0].(libdns.TXT)
+	if !ok {
+		t.Fatalf("expected a libdns.TXT, got %T", appended[0])
+	}
+	data, ok := txt.ProviderData.(ProviderData)
+	if !ok {
+		t.Fatalf("expected ProviderData, got %T", txt.ProviderData)
+	}
+	if data.ID == "" || data.ID == strconv.Itoa(manual) || data.DomainID != "123" {
+		t.Errorf("unexpected provider data %+v", data)
+	}
+	if until := time.Until(data.Expires); until <= 0 || until > 11*time.Minute {
+		t.Errorf("expected the challenge record to expire in about 10 minutes, got %v", data.Expires)
+	}
 
-		if p.isSessionValid(context.Background()) {
-			t.Error("expected session to be invalid with a bad cookie, but it was valid")
-		}
+	// Deleting the returned record removes exactly the row we created
+	deleted, err := p.DeleteRecords(ctx, "example.com.", appended)
+	if err != nil {
+		t.Fatalf("DeleteRecords failed: %v", err)
+	}
+	if len(deleted) != 1 {
+		t.Fatalf("expected 1 record deleted, got %d", len(deleted))
+	}
+	stored := server.Records("123")
+	if len(stored) != 1 || stored[0].ID != manual {
+		t.Errorf("expected only the hand-made record to remain, got %+v", stored)
+	}
+
+	// Deleting it again is silently ignored
+	deleted, err = p.DeleteRecords(ctx, "example.com.", appended)
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("expected nothing to be deleted, got %d records, err %v", len(deleted), err)
+	}
+}
+
+func TestProvider_DeleteRecords_ByValue(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.2"})
+	keep := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "TXT", TTL: 300, Data: "keep"})
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+
+	// Records made by hand are not deleted by default
+	deleted, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{
+		libdns.RR{Name: "www", Type: "A"},
+	})
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("expected unowned records to be skipped, got %d, err %v", len(deleted), err)
+	}
+	p.DeleteUnowned = true
+
+	// Data that doesn't match deletes nothing
+	deleted, err = p.DeleteRecords(ctx, "example.com.", []libdns.Record{
+		libdns.RR{Name: "www", Type: "A", Data: "192.0.2.9"},
 	})
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("expected nothing deleted, got %d, err %v", len(deleted), err)
+	}
+
+	// Empty data and TTL match the whole RRset
+	deleted, err = p.DeleteRecords(ctx, "example.com.", []libdns.Record{
+		libdns.RR{Name: "www", Type: "A"},
+	})
+	if err != nil {
+		t.Fatalf("DeleteRecords failed: %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("expected 2 records deleted, got %d", len(deleted))
+	}
+	if stored := server.Records("123"); len(stored) != 1 || stored[0].ID != keep {
+		t.Errorf("expected only the TXT record to remain, got %+v", stored)
+	}
+}
+
+func TestProvider_HostNameData(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	blog := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "blog", Type: "CNAME", TTL: 3600, Data: "www.example.com"})
 
-	// Test case 3: No session (no client)
-	t.Run("no session", func(t *testing.T) {
-		p := newTestProvider(server.URL)
-		if p.isSessionValid(context.Background()) {
-			t.Error("expected session to be invalid when no client exists, but it was valid")
+	p := newTestProvider(server.URL)
+	p.DeleteUnowned = true
+	ctx := context.Background()
+
+	// A fully qualified target is the record Tarka already has
+	if _, err := p.SetRecords(ctx, "example.com.", []libdns.Record{
+		libdns.CNAME{Name: "blog", TTL: time.Hour, Target: "WWW.example.com."},
+	}); err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+	if stored := server.Records("123"); len(stored) != 1 || stored[0].ID != blog {
+		t.Fatalf("expected the CNAME to be kept, got %+v", stored)
+	}
+
+	// New targets are stored without the trailing dot
+	if _, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.MX{Name: "@", Preference: 10, Target: "mail.example.com."},
+	}); err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	for _, rec := range server.Records("123") {
+		if rec.Type == "MX" && rec.Data != "10 mail.example.com" {
+			t.Errorf("expected MX data without the trailing dot, got %q", rec.Data)
 		}
+	}
+
+	deleted, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{
+		libdns.CNAME{Name: "blog", Target: "www.example.com."},
+	})
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("expected the CNAME to be deleted, got %d, err %v", len(deleted), err)
+	}
+}
+
+func TestProvider_SetRecords_ByID(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+	target := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.2"})
+
+	p := newTestProvider(server.URL)
+	_, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{
+		libdns.Address{
+			Name:         "www",
+			TTL:          5 * time.Minute,
+			IP:           netip.MustParseAddr("192.0.2.3"),
+			ProviderData: ProviderData{ID: strconv.Itoa(target), DomainID: "123"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+
+	stored := server.Records("123")
+	if len(stored) != 1 || stored[0].ID != target || stored[0].Data != "192.0.2.3" {
+		t.Errorf("expected record %d to be updated and the other deleted, got %+v", target, stored)
+	}
+}
+
+func TestProvider_LongTXT(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	dkim := `v=DKIM1; k=rsa; n="quoted \ note"; p=` + strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 16)
+	p := newTestProvider(server.URL)
+	_, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{
+		libdns.TXT{Name: "mail._domainkey", Text: dkim},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+
+	stored := server.Records("123")
+	if len(stored) != 1 {
+		t.Fatalf("expected 1 stored record, got %d", len(stored))
+	}
+	if !strings.HasPrefix(stored[0].Data, `"v=DKIM1; k=rsa; n=\"quoted \\ note\"; p=`) || !strings.Contains(stored[0].Data, `" "`) {
+		t.Errorf("expected the value to be sent as escaped character strings, got %q", stored[0].Data)
+	}
+
+	records, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatalf("GetRecords failed: %v", err)
+	}
+	if txt, ok := records[0].(libdns.TXT); !ok || txt.Text != dkim {
+		t.Errorf("expected the TXT value to round-trip, got %#v", records[0])
+	}
+}
+
+func TestProvider_DryRun(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+
+	p := newTestProvider(server.URL)
+	p.DryRun = true
+	p.DeleteUnowned = true
+	ctx := context.Background()
+
+	isDryRun := func(record libdns.Record) bool {
+		data, ok := providerDataOf(record)
+		return ok && data.DryRun
+	}
+
+	appended, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token"},
 	})
-}
\ No newline at end of file
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if len(appended) != 1 || !isDryRun(appended[0]) {
+		t.Errorf("expected the appended record to be marked as a dry run, got %+v", appended)
+	}
+
+	set, err := p.SetRecords(ctx, "example.com.", []libdns.Record{
+		libdns.RR{Name: "www", Type: "A", TTL: 300 * time.Second, Data: "192.0.2.2"},
+	})
+	if err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+	if len(set) != 1 || !isDryRun(set[0]) || set[0].RR().Data != "192.0.2.2" {
+		t.Errorf("expected the planned record to be returned as a dry run, got %+v", set)
+	}
+
+	deleted, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{libdns.RR{Name: "www", Type: "A"}})
+	if err != nil {
+		t.Fatalf("DeleteRecords failed: %v", err)
+	}
+	if len(deleted) != 1 || !isDryRun(deleted[0]) {
+		t.Errorf("expected the record that would be deleted to be returned, got %+v", deleted)
+	}
+
+	// Reads happened, but nothing was changed
+	if n := server.Requests("/custdata/domain-rr-edit.php"); n != 0 {
+		t.Errorf("expected no record forms to be submitted, got %d", n)
+	}
+	if stored := server.Records("123"); len(stored) != 1 || stored[0].Data != "192.0.2.1" {
+		t.Errorf("expected the zone to be unchanged, got %+v", stored)
+	}
+}
@@ -0,0 +1,561 @@
+package tarka
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(new(RFC2136))
+	httpcaddyfile.RegisterGlobalOption("tarka_rfc2136", parseRFC2136Option)
+}
+
+// rfc2136Timeout bounds the Tarka calls made for one update message
+const rfc2136Timeout = 2 * time.Minute
+
+// TSIGKey is a key update messages can be signed with
+type TSIGKey struct {
+	// Name of the key, e.g. certbot.
+	Name string `json:"name"`
+
+	// Algorithm, e.g. hmac-sha512 (defaults to hmac-sha256)
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Secret, base64 encoded as tsig-keygen prints it
+	Secret string `json:"secret"`
+}
+
+// RFC2136 is a Caddy app that accepts RFC 2136 dynamic updates signed with
+// TSIG and makes the changes through the Tarka provider, so tools that speak
+// RFC 2136 (certbot, dhcpd, external-dns) can manage Tarka zones. It also
+// answers SOA queries for the zones, which some of them use to find the zone
+// a name is in; it doesn't answer other queries.
+//
+// Tarka can't apply several changes atomically, so an update is checked in
+// full before any change is made, but a failure part way through leaves the
+// changes before it in place.
+type RFC2136 struct {
+	// Provider is the Tarka account the zones are in
+	Provider *Provider `json:"provider"`
+
+	// Listen addresses, for both UDP and TCP (defaults to :53)
+	Listen []string `json:"listen,omitempty"`
+
+	// Keys updates may be signed with; unsigned updates are refused
+	Keys []TSIGKey `json:"keys"`
+
+	// Zones that may be updated (defaults to every zone in the account)
+	Zones []string `json:"zones,omitempty"`
+
+	algorithms map[string]string
+	servers    []*dns.Server
+	log        *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*RFC2136) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tarka_rfc2136",
+		New: func() caddy.Module { return new(RFC2136) },
+	}
+}
+
+// Provision checks the keys and sets up the provider. Implements caddy.Provisioner.
+func (a *RFC2136) Provision(ctx caddy.Context) error {
+	a.log = ctx.Logger()
+	if a.Provider == nil {
+		return fmt.Errorf("tarka_rfc2136 needs a provider")
+	}
+	if len(a.Keys) == 0 {
+		return fmt.Errorf("tarka_rfc2136 needs at least one TSIG key")
+	}
+	if len(a.Listen) == 0 {
+		a.Listen = []string{":53"}
+	}
+	a.algorithms = make(map[string]string, len(a.Keys))
+	for i, key := range a.Keys {
+		key.Secret = caddy.NewReplacer().ReplaceAll(key.Secret, "")
+		if key.Name == "" || key.Secret == "" {
+			return fmt.Errorf("TSIG key %d needs a name and secret", i)
+		}
+		key.Name = dns.CanonicalName(key.Name)
+		if key.Algorithm == "" {
+			key.Algorithm = "hmac-sha256"
+		}
+		key.Algorithm = dns.CanonicalName(key.Algorithm)
+		switch key.Algorithm {
+		case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+		default:
+			return fmt.Errorf("TSIG key %s: unsupported algorithm %s", key.Name, key.Algorithm)
+		}
+		a.Keys[i] = key
+		a.algorithms[key.Name] = key.Algorithm
+	}
+	for i, zone := range a.Zones {
+		normalized, err := normalizeZone(zone)
+		if err != nil {
+			return err
+		}
+		a.Zones[i] = normalized
+	}
+	if err := a.Provider.Provision(ctx); err != nil {
+		return fmt.Errorf("provisioning provider: %w", err)
+	}
+	return nil
+}
+
+// Start listens for update messages. Implements caddy.App.
+func (a *RFC2136) Start() error {
+	secrets := make(map[string]string, len(a.Keys))
+	for _, key := range a.Keys {
+		secrets[key.Name] = key.Secret
+	}
+	for _, addr := range a.Listen {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			a.Stop()
+			return err
+		}
+		ln, err := net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			conn.Close()
+			a.Stop()
+			return err
+		}
+		for _, srv := range []*dns.Server{
+			{PacketConn: conn, Handler: a, TsigSecret: secrets, MsgAcceptFunc: acceptUpdates},
+			{Listener: ln, Handler: a, TsigSecret: secrets, MsgAcceptFunc: acceptUpdates},
+		} {
+			a.servers = append(a.servers, srv)
+			go func() {
+				if err := srv.ActivateAndServe(); err != nil {
+					a.log.Error("RFC 2136 server stopped", zap.Error(err))
+				}
+			}()
+		}
+		a.log.Info("Listening for RFC 2136 updates", zap.String("address", conn.LocalAddr().String()))
+	}
+	return nil
+}
+
+// Stop closes the listeners. Implements caddy.App.
+func (a *RFC2136) Stop() error {
+	for _, srv := range a.servers {
+		srv.Shutdown()
+	}
+	a.servers = nil
+	return nil
+}
+
+// Cleanup releases the provider, which Caddy only cleans up itself when it
+// loads it as a module. Implements caddy.CleanerUpper.
+func (a *RFC2136) Cleanup() error {
+	if a.Provider == nil {
+		return nil
+	}
+	return a.Provider.Cleanup()
+}
+
+// acceptUpdates accepts queries and updates with one question (the zone),
+// leaving the checks of the other sections to the handler
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 {
+		// A response
+		return dns.MsgIgnore
+	}
+	switch opcode := int(dh.Bits>>11) & 0xF; opcode {
+	case dns.OpcodeQuery, dns.OpcodeUpdate:
+	default:
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// ServeDNS answers a query or update message. Implements dns.Handler.
+func (a *RFC2136) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	ctx, cancel := context.WithTimeout(context.Background(), rfc2136Timeout)
+	defer cancel()
+
+	if req.Opcode == dns.OpcodeUpdate {
+		resp.Rcode = a.update(ctx, w, req)
+	} else {
+		a.query(ctx, req, resp)
+	}
+
+	// Sign the response with the key the request was signed with
+	if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		a.log.Debug("failed to write response", zap.Error(err))
+	}
+}
+
+// query answers SOA queries for the zones; everything else is refused
+func (a *RFC2136) query(ctx context.Context, req, resp *dns.Msg) {
+	q := req.Question[0]
+	zone := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	if q.Qtype != dns.TypeSOA || !a.zoneAllowed(ctx, zone) {
+		resp.Rcode = dns.RcodeRefused
+		return
+	}
+	resp.Authoritative = true
+	resp.Answer = append(resp.Answer, &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: client.DefaultTTL},
+		Ns:      dns.Fqdn(zone),
+		Mbox:    "hostmaster." + dns.Fqdn(zone),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	})
+}
+
+// update checks and applies an update message, returning the response code
+func (a *RFC2136) update(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) int {
+	tsig := req.IsTsig()
+	if tsig == nil {
+		a.log.Warn("refusing unsigned update", zap.String("remote", w.RemoteAddr().String()))
+		return dns.RcodeRefused
+	}
+	if err := w.TsigStatus(); err != nil {
+		a.log.Warn("refusing update with bad signature", zap.String("key", tsig.Hdr.Name), zap.String("remote", w.RemoteAddr().String()), zap.Error(err))
+		return dns.RcodeNotAuth
+	}
+	if algorithm, ok := a.algorithms[dns.CanonicalName(tsig.Hdr.Name)]; !ok || algorithm != dns.CanonicalName(tsig.Algorithm) {
+		return dns.RcodeNotAuth
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return dns.RcodeFormatError
+	}
+	zone := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	if !a.zoneAllowed(ctx, zone) {
+		return dns.RcodeNotAuth
+	}
+	log := a.log.With(zap.String("zone", zone), zap.String("key", tsig.Hdr.Name))
+
+	existing, err := a.Provider.GetRecords(ctx, zone)
+	if err != nil {
+		log.Error("failed to list records", zap.Error(err))
+		return dns.RcodeServerFailure
+	}
+	if rcode := checkPrerequisites(req.Answer, zone, existing); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	changes, rcode := parseUpdates(req.Ns, zone, existing)
+	if rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, change := range changes {
+		var changed []libdns.Record
+		if change.add {
+			changed, err = a.Provider.AppendRecords(ctx, zone, []libdns.Record{change.record})
+		} else {
+			changed, err = a.Provider.DeleteRecords(ctx, zone, []libdns.Record{change.record})
+		}
+		if err != nil {
+			log.Error("failed to apply update", zap.Bool("add", change.add), zap.String("name", change.record.Name), zap.String("type", change.record.Type), zap.Error(err))
+			return dns.RcodeServerFailure
+		}
+		if change.add {
+			existing = append(existing, changed...)
+			continue
+		}
+
+		// Without delete_unowned, DeleteRecords skips records it did not
+		// create; the client must not be told they are gone
+		selected := slices.DeleteFunc(slices.Clone(existing), func(r libdns.Record) bool { return !selectsRecord(change.record, r, zone) })
+		existing = slices.DeleteFunc(existing, func(r libdns.Record) bool {
+			return slices.ContainsFunc(changed, func(d libdns.Record) bool { return sameRecord(r, d, zone) })
+		})
+		if len(changed) < len(selected) {
+			log.Warn("refusing to delete records not created by this provider", zap.String("name", change.record.Name), zap.String("type", change.record.Type), zap.Int("skipped", len(selected)-len(changed)))
+			return dns.RcodeRefused
+		}
+	}
+	log.Info("Applied update", zap.Int("changes", len(changes)))
+	return dns.RcodeSuccess
+}
+
+// zoneAllowed reports whether a zone may be updated
+func (a *RFC2136) zoneAllowed(ctx context.Context, zone string) bool {
+	if len(a.Zones) > 0 {
+		return slices.Contains(a.Zones, zone)
+	}
+	zones, err := a.Provider.GetZones(ctx)
+	if err != nil {
+		a.log.Error("failed to list zones", zap.Error(err))
+		return false
+	}
+	for _, z := range zones {
+		if normalized, err := normalizeZone(z.Name); err == nil && normalized == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// updateChange is one add or delete an update message asks for
+type updateChange struct {
+	add    bool
+	record libdns.RR
+}
+
+// parseUpdates converts the update section of a message to changes, per
+// RFC 2136 section 3.4. Adds of records that already exist are dropped, and
+// deleting every RRset of the apex leaves its NS records alone.
+func parseUpdates(updates []dns.RR, zone string, existing []libdns.Record) ([]updateChange, int) {
+	var changes []updateChange
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name, err := tarkaName(hdr.Name, zone)
+		if err != nil {
+			return nil, dns.RcodeNotZone
+		}
+		recordType := dns.TypeToString[hdr.Rrtype]
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !client.IsSupportedType(recordType) {
+				return nil, dns.RcodeRefused
+			}
+			record, err := libdnsRR(rr, zone)
+			if err != nil {
+				return nil, dns.RcodeFormatError
+			}
+			if !slices.ContainsFunc(existing, func(r libdns.Record) bool { return sameRecord(r, record, zone) }) {
+				changes = append(changes, updateChange{add: true, record: record})
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return nil, dns.RcodeFormatError
+			}
+			if hdr.Rrtype != dns.TypeANY {
+				changes = append(changes, updateChange{record: libdns.RR{Name: libdnsName(name, zone), Type: recordType}})
+				continue
+			}
+			// Delete every RRset at the name, except the apex's NS
+			var types []string
+			for _, r := range existing {
+				rec := r.RR()
+				if rec.Name != libdnsName(name, zone) || slices.Contains(types, rec.Type) || (name == "" && rec.Type == "NS") {
+					continue
+				}
+				types = append(types, rec.Type)
+				changes = append(changes, updateChange{record: libdns.RR{Name: rec.Name, Type: rec.Type}})
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return nil, dns.RcodeFormatError
+			}
+			if !client.IsSupportedType(recordType) {
+				continue
+			}
+			record, err := libdnsRR(rr, zone)
+			if err != nil {
+				return nil, dns.RcodeFormatError
+			}
+			record.TTL = 0
+			changes = append(changes, updateChange{record: record})
+		default:
+			return nil, dns.RcodeFormatError
+		}
+	}
+	return changes, dns.RcodeSuccess
+}
+
+// checkPrerequisites checks the prerequisite section of a message against
+// the zone's records, per RFC 2136 section 3.2
+func checkPrerequisites(prereqs []dns.RR, zone string, existing []libdns.Record) int {
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name, err := tarkaName(hdr.Name, zone)
+		if err != nil {
+			return dns.RcodeNotZone
+		}
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		name = libdnsName(name, zone)
+		recordType := dns.TypeToString[hdr.Rrtype]
+		inUse, rrsetExists := false, false
+		for _, r := range existing {
+			rec := r.RR()
+			if rec.Name == name {
+				inUse = true
+				rrsetExists = rrsetExists || rec.Type == recordType
+			}
+		}
+
+		switch {
+		case hdr.Class == dns.ClassANY && hdr.Rrtype == dns.TypeANY:
+			if !inUse {
+				return dns.RcodeNameError
+			}
+		case hdr.Class == dns.ClassANY:
+			if !rrsetExists {
+				return dns.RcodeNXRrset
+			}
+		case hdr.Class == dns.ClassNONE && hdr.Rrtype == dns.TypeANY:
+			if inUse {
+				return dns.RcodeYXDomain
+			}
+		case hdr.Class == dns.ClassNONE:
+			if rrsetExists {
+				return dns.RcodeYXRrset
+			}
+		case hdr.Class == dns.ClassINET:
+			// Value-dependent: each record given must exist. RFC 2136 asks
+			// for the whole RRset to match; checking membership is enough
+			// for the tools that use this.
+			record, err := libdnsRR(rr, zone)
+			if err != nil {
+				return dns.RcodeFormatError
+			}
+			if !slices.ContainsFunc(existing, func(r libdns.Record) bool { return sameRecord(r, record, zone) }) {
+				return dns.RcodeNXRrset
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// libdnsRR converts a DNS record to a libdns record in zone, failing only
+// for TXT text with malformed escapes
+func libdnsRR(rr dns.RR, zone string) (libdns.RR, error) {
+	hdr := rr.Header()
+	name, _ := tarkaName(hdr.Name, zone)
+	// TXT data is the unescaped text, as libdns records carry it; other
+	// data is written as import writes it, without trailing dots
+	var data string
+	var err error
+	if txt, ok := rr.(*dns.TXT); ok {
+		data, err = txtText(txt)
+	} else {
+		data, err = tarkaData(rr)
+	}
+	if err != nil {
+		return libdns.RR{}, err
+	}
+	return libdns.RR{
+		Name: libdnsName(name, zone),
+		Type: dns.TypeToString[hdr.Rrtype],
+		TTL:  time.Duration(hdr.Ttl) * time.Second,
+		Data: data,
+	}, nil
+}
+
+// selectsRecord reports whether a delete change selects a record: the name
+// and type must match, and the data too if the change has any
+func selectsRecord(change libdns.RR, record libdns.Record, zone string) bool {
+	rr := record.RR()
+	if rr.Name != change.Name || rr.Type != change.Type {
+		return false
+	}
+	return change.Data == "" || sameRecord(record, change, zone)
+}
+
+// sameRecord reports whether two records have the same name, type and data
+func sameRecord(a, b libdns.Record, zone string) bool {
+	ra, err := toTarkaRecord(a, zone, "")
+	if err != nil {
+		return false
+	}
+	rb, err := toTarkaRecord(b, zone, "")
+	if err != nil {
+		return false
+	}
+	return ra.Name == rb.Name && ra.Type == rb.Type && canonicalData(ra) == canonicalData(rb)
+}
+
+// parseRFC2136Option parses the tarka_rfc2136 global option:
+//
+//	tarka_rfc2136 {
+//		provider {
+//			username  <user>
+//			password  <pass>
+//			...
+//		}
+//		listen <addresses...>
+//		key    <name> <algorithm> <secret>
+//		zones  <zones...>
+//	}
+func parseRFC2136Option(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(RFC2136)
+	d.Next() // consume option name
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "provider":
+			app.Provider = new(Provider)
+			if err := app.Provider.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+				return nil, err
+			}
+		case "listen":
+			addrs := d.RemainingArgs()
+			if len(addrs) == 0 {
+				return nil, d.ArgErr()
+			}
+			app.Listen = append(app.Listen, addrs...)
+		case "key":
+			var key TSIGKey
+			if !d.AllArgs(&key.Name, &key.Algorithm, &key.Secret) {
+				return nil, d.ArgErr()
+			}
+			app.Keys = append(app.Keys, key)
+		case "zones":
+			zones := d.RemainingArgs()
+			if len(zones) == 0 {
+				return nil, d.ArgErr()
+			}
+			app.Zones = append(app.Zones, zones...)
+		default:
+			return nil, d.Errf("unrecognized tarka_rfc2136 subdirective '%s'", d.Val())
+		}
+	}
+	if app.Provider == nil {
+		return nil, d.Err("missing 'provider'")
+	}
+	if len(app.Keys) == 0 {
+		return nil, d.Err("missing 'key'")
+	}
+
+	return httpcaddyfile.App{
+		Name:  "tarka_rfc2136",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*RFC2136)(nil)
+	_ caddy.Provisioner  = (*RFC2136)(nil)
+	_ caddy.CleanerUpper = (*RFC2136)(nil)
+	_ dns.Handler        = (*RFC2136)(nil)
+)
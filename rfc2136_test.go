@@ -0,0 +1,220 @@
+package tarka
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/miekg/dns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+const testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHMtb25seS0xMjM0NTY3OA=="
+
+func TestRFC2136(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 3600, Data: "192.0.2.1"})
+
+	app := &RFC2136{
+		Provider: newTestProvider(server.URL),
+		Listen:   []string{"127.0.0.1:0"},
+		Keys:     []TSIGKey{{Name: "certbot", Secret: testTSIGSecret}},
+	}
+	ctx, cancel := StandaloneContext(context.Background(), nil)
+	defer cancel()
+	if err := app.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	defer app.Cleanup()
+	if err := app.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer app.Stop()
+	addr := app.servers[0].PacketConn.LocalAddr().String()
+
+	exchange := func(m *dns.Msg, secret string) *dns.Msg {
+		t.Helper()
+		c := &dns.Client{Timeout: 5 * time.Second}
+		if secret != "" {
+			c.TsigSecret = map[string]string{"certbot.": secret}
+			m.SetTsig("certbot.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		resp, _, err := c.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		return resp
+	}
+	challenge := func() dns.RR {
+		rr, err := dns.NewRR(`_acme-challenge.example.com. 60 IN TXT "token"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	// Tools find the zone with a SOA query
+	soa := new(dns.Msg)
+	soa.SetQuestion("example.com.", dns.TypeSOA)
+	if resp := exchange(soa, testTSIGSecret); resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 1 {
+		t.Errorf("expected an authoritative SOA answer, got %v", resp)
+	}
+	soa.SetQuestion("example.org.", dns.TypeSOA)
+	if resp := exchange(soa, ""); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("expected a SOA query outside the account to be refused, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// Unsigned and badly signed updates are refused
+	add := new(dns.Msg)
+	add.SetUpdate("example.com.")
+	add.Insert([]dns.RR{challenge()})
+	if resp := exchange(add.Copy(), ""); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("expected an unsigned update to be refused, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := exchange(add.Copy(), "d3Jvbmc="); resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("expected a badly signed update to be rejected, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if len(server.Records("123")) != 1 {
+		t.Fatal("expected no records to be added by rejected updates")
+	}
+
+	// A signed update adds the record
+	if resp := exchange(add.Copy(), testTSIGSecret); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the update to succeed, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	found := false
+	for _, rec := range server.Records("123") {
+		found = found || (rec.Name == "_acme-challenge" && rec.Type == "TXT" && rec.Data == "token")
+	}
+	if !found {
+		t.Fatalf("expected the TXT record to be added, got %+v", server.Records("123"))
+	}
+
+	// Prerequisites are checked before anything changes
+	guarded := new(dns.Msg)
+	guarded.SetUpdate("example.com.")
+	guarded.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.example.com."}}})
+	guarded.RemoveRRset([]dns.RR{challenge()})
+	if resp := exchange(guarded, testTSIGSecret); resp.Rcode != dns.RcodeYXDomain {
+		t.Errorf("expected YXDOMAIN for a name in use, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// Deleting the RRset removes the record
+	remove := new(dns.Msg)
+	remove.SetUpdate("example.com.")
+	remove.RRsetUsed([]dns.RR{challenge()})
+	remove.RemoveRRset([]dns.RR{challenge()})
+	if resp := exchange(remove, testTSIGSecret); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the delete to succeed, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if records := server.Records("123"); len(records) != 1 || records[0].Name != "www" {
+		t.Errorf("expected only www to remain, got %+v", records)
+	}
+
+	// Names outside the zone are rejected
+	outside := new(dns.Msg)
+	outside.SetUpdate("example.com.")
+	rr, _ := dns.NewRR(`host.example.org. 60 IN A 192.0.2.9`)
+	outside.Insert([]dns.RR{rr})
+	if resp := exchange(outside, testTSIGSecret); resp.Rcode != dns.RcodeNotZone {
+		t.Errorf("expected NOTZONE, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	// Host names are stored without their trailing dot, so a delete of the
+	// same record matches it
+	alias := new(dns.Msg)
+	alias.SetUpdate("example.com.")
+	rr, _ = dns.NewRR(`alias.example.com. 60 IN CNAME target.example.net.`)
+	alias.Insert([]dns.RR{rr})
+	if resp := exchange(alias, testTSIGSecret); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the update to succeed, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	found = false
+	for _, rec := range server.Records("123") {
+		found = found || (rec.Name == "alias" && rec.Data == "target.example.net")
+	}
+	if !found {
+		t.Fatalf("expected the CNAME to be stored without a trailing dot, got %+v", server.Records("123"))
+	}
+	unalias := new(dns.Msg)
+	unalias.SetUpdate("example.com.")
+	unalias.Remove([]dns.RR{rr})
+	if resp := exchange(unalias, testTSIGSecret); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the delete to succeed, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rec := range server.Records("123") {
+		if rec.Name == "alias" {
+			t.Errorf("expected the CNAME to be deleted, got %+v", rec)
+		}
+	}
+
+	// Records the provider did not create are kept, and the update refused
+	unowned := new(dns.Msg)
+	unowned.SetUpdate("example.com.")
+	unowned.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.example.com."}}})
+	if resp := exchange(unowned, testTSIGSecret); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("expected deleting an unowned record to be refused, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	if records := server.Records("123"); len(records) != 1 || records[0].Name != "www" {
+		t.Errorf("expected www to remain, got %+v", records)
+	}
+
+	// TXT text arrives escaped as in zone files and is stored unescaped
+	quoted := new(dns.Msg)
+	quoted.SetUpdate("example.com.")
+	rr, _ = dns.NewRR(`quoted.example.com. 60 IN TXT "say \"hi\""`)
+	quoted.Insert([]dns.RR{rr})
+	if resp := exchange(quoted, testTSIGSecret); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the update to succeed, got %s", dns.RcodeToString[resp.Rcode])
+	}
+	found = false
+	for _, rec := range server.Records("123") {
+		found = found || (rec.Name == "quoted" && rec.Data == `"say \"hi\""`)
+	}
+	if !found {
+		t.Errorf("expected the TXT text to be stored unescaped, got %+v", server.Records("123"))
+	}
+}
+
+func TestParseRFC2136Option(t *testing.T) {
+	input := `tarka_rfc2136 {
+		provider {
+			username  testuser
+			password  testpass
+			domain_id 123
+		}
+		listen 127.0.0.1:5353
+		key    certbot hmac-sha512 ` + testTSIGSecret + `
+		zones  example.com
+	}`
+
+	val, err := parseRFC2136Option(caddyfile.NewTestDispenser(input), nil)
+	if err != nil {
+		t.Fatalf("did not expect an error but got: %v", err)
+	}
+	var app RFC2136
+	if err := json.Unmarshal(val.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatalf("failed to decode app config: %v", err)
+	}
+	if len(app.Keys) != 1 || app.Keys[0].Algorithm != "hmac-sha512" || app.Keys[0].Secret != testTSIGSecret {
+		t.Errorf("unexpected keys %+v", app.Keys)
+	}
+	if len(app.Listen) != 1 || len(app.Zones) != 1 || app.Provider == nil {
+		t.Errorf("unexpected listen %v, zones %v or provider", app.Listen, app.Zones)
+	}
+
+	if _, err := parseRFC2136Option(caddyfile.NewTestDispenser(`tarka_rfc2136 {
+		provider {
+			username  testuser
+			password  testpass
+			domain_id 123
+		}
+	}`), nil); err == nil {
+		t.Error("expected an error without a key")
+	}
+}
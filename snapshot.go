@@ -0,0 +1,207 @@
+package tarka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+// defaultSnapshotsKept is how many snapshots of each zone are kept by default
+const defaultSnapshotsKept = 20
+
+// snapshotNameFormat names snapshots by the UTC time they were taken, e.g.
+// 20261018-142501.250, so they sort oldest first
+const snapshotNameFormat = "20060102-150405.000"
+
+// SnapshotConfig makes the provider save a snapshot of a zone, as a zone
+// file, before SetRecords or an applied plan changes it. A snapshot can be
+// restored with PlanRollback.
+type SnapshotConfig struct {
+	// Dir to keep snapshots in, one subdirectory per zone (defaults to
+	// Caddy's storage)
+	Dir string `json:"dir,omitempty"`
+
+	// Keep is how many snapshots of each zone to keep, oldest removed first
+	// (defaults to 20)
+	Keep int `json:"keep,omitempty"`
+}
+
+// snapshotStore saves zone snapshots in storage under prefix/<zone>/<name>.zone
+type snapshotStore struct {
+	storage certmagic.Storage
+	prefix  string
+	keep    int
+}
+
+// setupSnapshots prepares the snapshot store for a Tarka instance, in
+// p.Snapshots.Dir if set and p.storage otherwise
+func (p *Provider) setupSnapshots(baseURL string) error {
+	cfg := p.Snapshots
+	if cfg.Keep < 0 {
+		return fmt.Errorf("invalid snapshot keep %d: must not be negative", cfg.Keep)
+	}
+	store := &snapshotStore{keep: cfg.Keep}
+	if store.keep == 0 {
+		store.keep = defaultSnapshotsKept
+	}
+	if cfg.Dir != "" {
+		store.storage = &certmagic.FileStorage{Path: cfg.Dir}
+	} else {
+		if p.storage == nil {
+			return fmt.Errorf("snapshots need a dir when Caddy's storage is unavailable")
+		}
+		store.storage = p.storage
+		store.prefix = storagePrefix("snapshots", baseURL)
+	}
+	p.snapshots = store
+	return nil
+}
+
+func (s *snapshotStore) zonePrefix(zone string) (string, error) {
+	zone, err := normalizeZone(zone)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.prefix, certmagic.StorageKeys.Safe(zone)), nil
+}
+
+// save stores the records of a zone as a new snapshot, removing the oldest
+// ones beyond the number to keep, and returns the snapshot's name
+func (s *snapshotStore) save(ctx context.Context, zone, domainID string, records []client.Record) (string, error) {
+	prefix, err := s.zonePrefix(zone)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	name := now.Format(snapshotNameFormat)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; Tarka domain %s, snapshot taken %s\n", domainID, now.Format(time.RFC3339))
+	if err := writeZoneFile(&buf, zone, records); err != nil {
+		return "", err
+	}
+	if err := s.storage.Store(ctx, path.Join(prefix, name+".zone"), buf.Bytes()); err != nil {
+		return "", fmt.Errorf("failed to store snapshot: %w", err)
+	}
+
+	names, err := s.list(ctx, zone)
+	if err != nil {
+		return "", err
+	}
+	for len(names) > s.keep {
+		if err := s.storage.Delete(ctx, path.Join(prefix, names[0]+".zone")); err != nil {
+			return "", fmt.Errorf("failed to remove old snapshot %s: %w", names[0], err)
+		}
+		names = names[1:]
+	}
+	return name, nil
+}
+
+// list returns the names of a zone's snapshots, oldest first
+func (s *snapshotStore) list(ctx context.Context, zone string) ([]string, error) {
+	prefix, err := s.zonePrefix(zone)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.storage.List(ctx, prefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var names []string
+	for _, key := range keys {
+		if name, ok := strings.CutSuffix(path.Base(key), ".zone"); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// load returns a snapshot's zone file
+func (s *snapshotStore) load(ctx context.Context, zone, name string) ([]byte, error) {
+	prefix, err := s.zonePrefix(zone)
+	if err != nil {
+		return nil, err
+	}
+	if name != certmagic.StorageKeys.Safe(name) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	data, err := s.storage.Load(ctx, path.Join(prefix, name+".zone"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no snapshot %s of zone %s", name, zone)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// snapshotZone saves the records of a zone, as just listed, before they are
+// changed. It does nothing when snapshots are off or in a dry run, which
+// changes nothing.
+func (p *Provider) snapshotZone(ctx context.Context, zone, domainID string, records []client.Record) error {
+	if p.snapshots == nil || p.DryRun {
+		return nil
+	}
+	name, err := p.snapshots.save(ctx, zone, domainID, records)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot zone %s: %w", zone, err)
+	}
+	p.log.Info("Saved zone snapshot", zap.String("zone", zone), zap.String("snapshot", name))
+	return nil
+}
+
+// ListSnapshots returns the names of a zone's snapshots, oldest first
+func (p *Provider) ListSnapshots(ctx context.Context, zone string) ([]string, error) {
+	if p.snapshots == nil {
+		return nil, fmt.Errorf("snapshots are not enabled")
+	}
+	return p.snapshots.list(ctx, zone)
+}
+
+// PlanRollback plans the changes that restore a zone to a snapshot: records
+// added since are deleted, and changed or deleted ones are put back.
+func (p *Provider) PlanRollback(ctx context.Context, zone, name string) (_ *Plan, err error) {
+	ctx, span := p.startSpan(ctx, "PlanRollback", zone, nil)
+	defer func() { endSpan(span, err) }()
+
+	if p.snapshots == nil {
+		return nil, fmt.Errorf("snapshots are not enabled")
+	}
+	data, err := p.snapshots.load(ctx, zone, name)
+	if err != nil {
+		return nil, err
+	}
+	desired, _, err := parseZoneFile(bytes.NewReader(data), zone)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+
+	c, domainID, err := p.zoneClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Plan{
+		Zone:     zone,
+		DomainID: domainID,
+		Changes:  diffRecords(existing, desired, true),
+	}, nil
+}
@@ -0,0 +1,89 @@
+package tarka
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestProvider_Rollback(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "", Type: "TXT", TTL: 3600, Data: "v=spf1 -all"})
+
+	p := newTestProvider(server.URL)
+	p.DeleteUnowned = true
+	p.Snapshots = &SnapshotConfig{Dir: t.TempDir(), Keep: 2}
+	if err := p.setupSnapshots(server.BaseURL()); err != nil {
+		t.Fatalf("setupSnapshots failed: %v", err)
+	}
+	ctx := context.Background()
+
+	// A bad deployment changes www, and the TXT record is deleted
+	if _, err := p.SetRecords(ctx, "example.com.", []libdns.Record{
+		libdns.Address{Name: "www", TTL: 5 * time.Minute, IP: netip.MustParseAddr("192.0.2.66")},
+	}); err != nil {
+		t.Fatalf("SetRecords failed: %v", err)
+	}
+	for _, rec := range server.Records("123") {
+		if rec.Type == "TXT" {
+			if _, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{libdns.TXT{Name: "@", Text: rec.Data}}); err != nil {
+				t.Fatalf("DeleteRecords failed: %v", err)
+			}
+		}
+	}
+
+	names, err := p.ListSnapshots(ctx, "example.com.")
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected 1 snapshot, got %v", names)
+	}
+
+	plan, err := p.PlanRollback(ctx, "example.com.", names[0])
+	if err != nil {
+		t.Fatalf("PlanRollback failed: %v", err)
+	}
+	if plan.Count(ActionUpdate) != 1 || plan.Count(ActionAdd) != 1 || plan.Count(ActionDelete) != 0 {
+		var buf bytes.Buffer
+		plan.WriteTo(&buf)
+		t.Fatalf("expected 1 update and 1 add, got:\n%s", buf.String())
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+
+	again, err := p.PlanRollback(ctx, "example.com.", names[0])
+	if err != nil {
+		t.Fatalf("PlanRollback failed: %v", err)
+	}
+	if !again.Empty() {
+		t.Errorf("expected the zone to match the snapshot after rolling back, got %d changes", len(again.Changes))
+	}
+
+	// Applying the plan took another snapshot; older ones beyond keep go
+	for range 2 {
+		if err := p.ApplyPlan(ctx, again); err != nil {
+			t.Fatalf("ApplyPlan failed: %v", err)
+		}
+	}
+	names, err = p.ListSnapshots(ctx, "example.com.")
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(names) != 2 {
+		t.Errorf("expected 2 snapshots kept, got %v", names)
+	}
+
+	if _, err := p.PlanRollback(ctx, "example.com.", "19700101-000000.000"); err == nil {
+		t.Error("expected an error for a missing snapshot")
+	}
+}
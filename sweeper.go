@@ -0,0 +1,138 @@
+package tarka
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nsna/tarka/client"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSweepInterval = 15 * time.Minute
+	defaultSweepMaxAge   = time.Hour
+)
+
+// SweeperConfig enables periodic removal of stale ACME challenge records
+type SweeperConfig struct {
+	// How often to look for stale records (defaults to 15m)
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// How old a challenge record must be before it is removed (defaults to 1h)
+	MaxAge time.Duration `json:"max_age,omitempty"`
+}
+
+// isChallengeRecord reports whether a ledger entry is an ACME challenge
+// record. Delegated ones are named after their delegation target, so the
+// certificate they validate is what marks them.
+func isChallengeRecord(entry ledgerEntry) bool {
+	return entry.Type == "TXT" && (entry.Certificate != "" || strings.HasPrefix(entry.Name, "_acme-challenge"))
+}
+
+// runSweeper sweeps stale challenge records every interval until ctx is done
+func (p *Provider) runSweeper(ctx context.Context) {
+	interval := p.Sweeper.Interval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sweep(ctx)
+		}
+	}
+}
+
+// sweep deletes ACME challenge TXT records this provider created that are
+// older than the configured max age, returning how many it deleted. Failed
+// or aborted orders otherwise leave them behind until Tarka expires them.
+func (p *Provider) sweep(ctx context.Context) int {
+	maxAge := defaultSweepMaxAge
+	if p.Sweeper != nil && p.Sweeper.MaxAge > 0 {
+		maxAge = p.Sweeper.MaxAge
+	}
+	cutoff := time.Now().Add(-maxAge)
+
+	// Pick up entries added by other instances or before a restart
+	if err := p.ledger.load(ctx); err != nil {
+		p.log.Error("sweeper failed to load ledger", zap.Error(err))
+	}
+
+	// Group stale entries by domain so each domain is listed once
+	stale := make(map[string][]ledgerEntry)
+	for _, entry := range p.ledger.list() {
+		if isChallengeRecord(entry) && entry.Created.Before(cutoff) {
+			stale[entry.DomainID] = append(stale[entry.DomainID], entry)
+		}
+	}
+	if len(stale) == 0 {
+		return 0
+	}
+
+	c, err := p.getClient()
+	if err != nil {
+		p.log.Error("sweeper could not create client", zap.Error(err))
+		return 0
+	}
+
+	removed := 0
+	for domainID, entries := range stale {
+		removed += p.sweepDomain(ctx, c, domainID, entries)
+	}
+	return removed
+}
+
+// sweepDomain deletes the given stale entries of one domain that are still
+// present, holding the domain's lock while it does
+func (p *Provider) sweepDomain(ctx context.Context, c *client.Client, domainID string, entries []ledgerEntry) int {
+	unlock, err := p.lockZone(ctx, c.BaseURL(), domainID)
+	if err != nil {
+		p.log.Error("sweeper could not lock domain", zap.String("domain_id", domainID), zap.Error(err))
+		return 0
+	}
+	defer unlock()
+
+	listed, err := p.listRecords(ctx, c, entries[0].Zone, domainID)
+	if err != nil {
+		p.log.Error("sweeper failed to list records", zap.String("domain_id", domainID), zap.Error(err))
+		return 0
+	}
+	present := make(map[string]bool, len(listed))
+	for _, rec := range listed {
+		present[rec.ID] = true
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !present[entry.ID] {
+			// Already gone, most likely expired by Tarka
+			p.recordDeleted(ctx, domainID, entry.ID)
+			continue
+		}
+		err := c.DeleteRecord(ctx, domainID, entry.ID)
+		p.countChange("delete", entry.Type, err)
+		p.audit(ctx, entry.Zone, domainID, &client.Record{ID: entry.ID, Name: entry.Name, Type: entry.Type}, nil, err)
+		if err != nil {
+			p.log.Error("sweeper failed to delete stale challenge record",
+				zap.String("zone", entry.Zone),
+				zap.String("name", entry.Name),
+				zap.String("id", entry.ID),
+				zap.Error(err))
+			continue
+		}
+		p.recordDeleted(ctx, domainID, entry.ID)
+		removed++
+		p.log.Info("sweeper removed stale challenge record",
+			zap.String("zone", entry.Zone),
+			zap.String("name", entry.Name),
+			zap.String("id", entry.ID),
+			zap.Time("created", entry.Created))
+	}
+	return removed
+}
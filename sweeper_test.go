@@ -0,0 +1,67 @@
+package tarka
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestProvider_sweep(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	manual := server.AddRecord(tarkatest.Record{DomainID: "123", Name: "_acme-challenge", Type: "TXT", Data: "by-hand"})
+
+	ctx := context.Background()
+	p := newTestProvider(server.URL)
+	p.Sweeper = &SweeperConfig{MaxAge: time.Hour}
+
+	appended, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "stale"},
+		libdns.TXT{Name: "_acme-challenge.www", Text: "fresh"},
+		libdns.TXT{Name: "spf", Text: "v=spf1 -all"},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	staleID := appended[0].(libdns.TXT).ProviderData.(ProviderData).ID
+
+	// Nothing is old enough yet
+	if removed := p.sweep(ctx); removed != 0 {
+		t.Fatalf("expected nothing to be swept, got %d", removed)
+	}
+
+	// Age the first challenge record and the non-challenge record past the max age
+	for _, entry := range p.ledger.list() {
+		if entry.ID == staleID || entry.Name == "spf" {
+			entry.Created = time.Now().Add(-2 * time.Hour)
+			p.ledger.add(ctx, entry)
+		}
+	}
+
+	if removed := p.sweep(ctx); removed != 1 {
+		t.Fatalf("expected 1 record to be swept, got %d", removed)
+	}
+	remaining := make(map[string]bool)
+	for _, rec := range server.Records("123") {
+		remaining[rec.Data] = true
+	}
+	if remaining["stale"] {
+		t.Error("expected the stale challenge record to be deleted")
+	}
+	if !remaining["fresh"] || !remaining["v=spf1 -all"] || !remaining["by-hand"] {
+		t.Errorf("expected other records to be kept, got %v", remaining)
+	}
+	for _, entry := range p.ledger.list() {
+		if entry.ID == staleID {
+			t.Error("expected the swept record to be removed from the ledger")
+		}
+		if entry.ID == strconv.Itoa(manual) {
+			t.Error("expected the hand-made record not to be in the ledger")
+		}
+	}
+}
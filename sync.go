@@ -0,0 +1,240 @@
+package tarka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nsna/tarka/client"
+	"gopkg.in/yaml.v3"
+)
+
+// Ownership markers are TXT records at _tarka-owner.<name>, one per RRset a
+// sync owner manages, e.g. "heritage=tarka-sync,owner=gitops,type=A". They
+// let a later sync tell the records it manages from ones made by hand.
+const (
+	markerPrefix   = "_tarka-owner"
+	markerHeritage = "heritage=tarka-sync"
+
+	// DefaultSyncOwner is the owner recorded in markers when the desired
+	// state names none
+	DefaultSyncOwner = "tarka-sync"
+)
+
+// DesiredState is a zone's records as declared in a checked-in YAML or JSON
+// file. Only the RRsets (name and type) it lists are managed by a sync.
+type DesiredState struct {
+	// Zone the records belong to, e.g. example.com
+	Zone string `json:"zone" yaml:"zone"`
+
+	// Owner identifies this file in ownership markers, so several files
+	// can manage different records of one zone (defaults to DefaultSyncOwner)
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+
+	Records []DesiredRecord `json:"records" yaml:"records"`
+}
+
+// DesiredRecord is one record of a DesiredState
+type DesiredRecord struct {
+	// Name relative to the zone, with "@" for the apex
+	Name string `json:"name" yaml:"name"`
+
+	// Type, e.g. A
+	Type string `json:"type" yaml:"type"`
+
+	// TTL in seconds (defaults to the provider's default TTL)
+	TTL int `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+
+	// Data as libdns takes it, e.g. "10 mail.example.com." for MX, or the
+	// unquoted text of a TXT record
+	Data string `json:"data" yaml:"data"`
+}
+
+// ParseDesiredState reads a desired state file. JSON is read when isJSON is
+// set, YAML otherwise; unknown fields are rejected in both, to catch typos.
+func ParseDesiredState(r io.Reader, isJSON bool) (*DesiredState, error) {
+	var state DesiredState
+	if isJSON {
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&state); err != nil {
+			return nil, fmt.Errorf("failed to parse desired state: %w", err)
+		}
+	} else {
+		dec := yaml.NewDecoder(r)
+		dec.KnownFields(true)
+		if err := dec.Decode(&state); err != nil {
+			return nil, fmt.Errorf("failed to parse desired state: %w", err)
+		}
+	}
+	if state.Zone == "" {
+		return nil, fmt.Errorf("desired state has no zone")
+	}
+	if state.Owner == "" {
+		state.Owner = DefaultSyncOwner
+	}
+	if err := validateSyncOwner(state.Owner); err != nil {
+		return nil, err
+	}
+	for i, rec := range state.Records {
+		if rec.Type == "" || rec.Data == "" {
+			return nil, fmt.Errorf("record %d (%s) needs a type and data", i+1, rec.Name)
+		}
+		if strings.ContainsAny(rec.Name+rec.Type+rec.Data, "\r\n") {
+			return nil, fmt.Errorf("record %d (%s) spans more than one line", i+1, rec.Name)
+		}
+	}
+	return &state, nil
+}
+
+// validateSyncOwner checks that owner can be written into the
+// heritage=...,owner=... marker records and read back
+func validateSyncOwner(owner string) error {
+	if owner == "" || strings.ContainsAny(owner, ", \"") {
+		return fmt.Errorf("invalid owner %q: must be set and not contain commas, spaces or quotes", owner)
+	}
+	return nil
+}
+
+// zoneFile renders the desired records as a zone file, so they are parsed
+// and converted the same way an imported zone file is
+func (s *DesiredState) zoneFile(defaultTTL int) string {
+	var sb strings.Builder
+	for _, rec := range s.Records {
+		ttl := rec.TTL
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+		data := rec.Data
+		if strings.EqualFold(rec.Type, "TXT") {
+			data = client.QuoteTXT(data)
+		}
+		name := rec.Name
+		if name == "" {
+			name = "@"
+		}
+		fmt.Fprintf(&sb, "%s %d IN %s %s\n", name, ttl, strings.ToUpper(rec.Type), data)
+	}
+	return sb.String()
+}
+
+// PlanSync plans the changes that make the RRsets declared in state match
+// Tarka, adding ownership markers for them. RRsets neither declared nor
+// marked as owned by state's owner are never touched. RRsets the owner
+// marked but that are no longer declared are deleted only with prune set.
+func (p *Provider) PlanSync(ctx context.Context, state *DesiredState, prune bool) (_ *Plan, err error) {
+	zone := state.Zone
+	ctx, span := p.startSpan(ctx, "PlanSync", zone, nil)
+	defer func() { endSpan(span, err) }()
+
+	if err := validateSyncOwner(state.Owner); err != nil {
+		return nil, err
+	}
+
+	defaultTTL, err := p.effectiveTTL(0)
+	if err != nil {
+		return nil, err
+	}
+	desired, unsupported, err := parseZoneFile(strings.NewReader(state.zoneFile(defaultTTL)), zone)
+	if err != nil {
+		return nil, err
+	}
+	for i := range desired {
+		if desired[i].TTL, err = p.effectiveTTL(time.Duration(desired[i].TTL) * time.Second); err != nil {
+			return nil, fmt.Errorf("invalid record %s: %w", desired[i].Name, err)
+		}
+	}
+
+	c, domainID, err := p.zoneClient(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	listed, err := p.listRecords(ctx, c, zone, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out which RRsets are in scope: those declared, and with prune
+	// set, those the owner marked before
+	declared := make(map[rrset]bool)
+	for _, rec := range desired {
+		declared[rrset{rec.Name, rec.Type}] = true
+	}
+	owned := make(map[rrset]bool)
+	var ownMarkers []client.Record
+	for _, rec := range listed {
+		if key, ok := parseMarker(rec, state.Owner); ok {
+			owned[key] = true
+			ownMarkers = append(ownMarkers, rec)
+		}
+	}
+
+	existing := ownMarkers
+	for _, rec := range listed {
+		key := rrset{rec.Name, rec.Type}
+		if declared[key] || (prune && owned[key]) {
+			existing = append(existing, rec)
+		}
+	}
+
+	// Mark every declared RRset, and keep the markers of owned RRsets that
+	// are being kept
+	keep := declared
+	if !prune {
+		keep = make(map[rrset]bool, len(declared)+len(owned))
+		for key := range declared {
+			keep[key] = true
+		}
+		for key := range owned {
+			keep[key] = true
+		}
+	}
+	for key := range keep {
+		desired = append(desired, markerRecord(key, state.Owner, defaultTTL))
+	}
+
+	return &Plan{
+		Zone:        zone,
+		DomainID:    domainID,
+		Changes:     diffRecords(existing, desired, true),
+		Unsupported: unsupported,
+	}, nil
+}
+
+// rrset identifies an RRset by its Tarka name and type
+type rrset struct{ name, recordType string }
+
+// markerRecord returns the ownership marker for an RRset
+func markerRecord(key rrset, owner string, ttl int) client.Record {
+	name := markerPrefix
+	if key.name != "" {
+		name += "." + key.name
+	}
+	return client.Record{
+		Name: name,
+		Type: "TXT",
+		TTL:  ttl,
+		Data: fmt.Sprintf("%s,owner=%s,type=%s", markerHeritage, owner, key.recordType),
+	}
+}
+
+// parseMarker returns the RRset a record marks as owned by owner, if it is
+// such a marker
+func parseMarker(rec client.Record, owner string) (rrset, bool) {
+	if rec.Type != "TXT" || (rec.Name != markerPrefix && !strings.HasPrefix(rec.Name, markerPrefix+".")) {
+		return rrset{}, false
+	}
+	text, err := client.DecodeTXT(rec.Data)
+	if err != nil {
+		return rrset{}, false
+	}
+	fields := strings.Split(text, ",")
+	if len(fields) != 3 || fields[0] != markerHeritage || fields[1] != "owner="+owner || !strings.HasPrefix(fields[2], "type=") {
+		return rrset{}, false
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(rec.Name, markerPrefix), ".")
+	return rrset{name, strings.TrimPrefix(fields[2], "type=")}, true
+}
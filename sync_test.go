@@ -0,0 +1,134 @@
+package tarka
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+const testDesiredState = `
+zone: example.com
+owner: gitops
+records:
+  - name: www
+    type: A
+    ttl: 300
+    data: 192.0.2.10
+  - name: "@"
+    type: TXT
+    data: v=spf1 -all
+`
+
+func TestParseDesiredState(t *testing.T) {
+	state, err := ParseDesiredState(strings.NewReader(testDesiredState), false)
+	if err != nil {
+		t.Fatalf("ParseDesiredState failed: %v", err)
+	}
+	if state.Zone != "example.com" || state.Owner != "gitops" || len(state.Records) != 2 {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	state, err = ParseDesiredState(strings.NewReader(`{"zone": "example.com", "records": [{"name": "www", "type": "A", "data": "192.0.2.10"}]}`), true)
+	if err != nil {
+		t.Fatalf("ParseDesiredState failed: %v", err)
+	}
+	if state.Owner != DefaultSyncOwner {
+		t.Errorf("expected the default owner, got %q", state.Owner)
+	}
+
+	for _, input := range []string{
+		"records: []\n",
+		"zone: example.com\nrecords:\n  - name: www\n    type: A\n    value: 192.0.2.10\n",
+		"zone: example.com\nowner: a,b\n",
+	} {
+		if _, err := ParseDesiredState(strings.NewReader(input), false); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+}
+
+func TestProvider_PlanSync(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "www", Type: "A", TTL: 300, Data: "192.0.2.1"})
+	server.AddRecord(tarkatest.Record{DomainID: "123", Name: "manual", Type: "A", TTL: 3600, Data: "192.0.2.50"})
+
+	p := newTestProvider(server.URL)
+	ctx := context.Background()
+	state, err := ParseDesiredState(strings.NewReader(testDesiredState), false)
+	if err != nil {
+		t.Fatalf("ParseDesiredState failed: %v", err)
+	}
+
+	// An owner set after parsing, as --owner does, is checked too
+	bad := *state
+	bad.Owner = "team a,owner=b"
+	if _, err := p.PlanSync(ctx, &bad, true); err == nil {
+		t.Error("expected an owner with a comma and space to be rejected")
+	}
+
+	plan, err := p.PlanSync(ctx, state, true)
+	if err != nil {
+		t.Fatalf("PlanSync failed: %v", err)
+	}
+	var buf bytes.Buffer
+	plan.WriteTo(&buf)
+	// One update for www, and adds for the TXT record and both markers
+	if plan.Count(ActionUpdate) != 1 || plan.Count(ActionAdd) != 3 || plan.Count(ActionDelete) != 0 {
+		t.Fatalf("expected 1 update and 3 adds, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "_tarka-owner.www") {
+		t.Errorf("expected an ownership marker for www, got:\n%s", buf.String())
+	}
+	if err := p.ApplyPlan(ctx, plan); err != nil {
+		t.Fatalf("ApplyPlan failed: %v", err)
+	}
+
+	again, err := p.PlanSync(ctx, state, true)
+	if err != nil {
+		t.Fatalf("PlanSync failed: %v", err)
+	}
+	if !again.Empty() {
+		buf.Reset()
+		again.WriteTo(&buf)
+		t.Fatalf("expected no drift after applying, got:\n%s", buf.String())
+	}
+
+	// Dropping www from the file leaves it alone unless pruning, and the
+	// unmanaged record is never touched either way
+	state.Records = state.Records[1:]
+	kept, err := p.PlanSync(ctx, state, false)
+	if err != nil {
+		t.Fatalf("PlanSync failed: %v", err)
+	}
+	if !kept.Empty() {
+		buf.Reset()
+		kept.WriteTo(&buf)
+		t.Errorf("expected no changes without pruning, got:\n%s", buf.String())
+	}
+	pruned, err := p.PlanSync(ctx, state, true)
+	if err != nil {
+		t.Fatalf("PlanSync failed: %v", err)
+	}
+	buf.Reset()
+	pruned.WriteTo(&buf)
+	if pruned.Count(ActionDelete) != 2 || !strings.Contains(buf.String(), "- www 300 A") || strings.Contains(buf.String(), "manual") {
+		t.Errorf("expected www and its marker to be deleted, got:\n%s", buf.String())
+	}
+
+	// Markers of another owner don't count as ownership
+	state.Owner = "someone-else"
+	other, err := p.PlanSync(ctx, state, true)
+	if err != nil {
+		t.Fatalf("PlanSync failed: %v", err)
+	}
+	if other.Count(ActionDelete) != 0 {
+		buf.Reset()
+		other.WriteTo(&buf)
+		t.Errorf("expected another owner not to delete anything, got:\n%s", buf.String())
+	}
+}
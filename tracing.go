@@ -0,0 +1,93 @@
+package tarka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/libdns/libdns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName identifies the provider's spans
+const tracerName = "github.com/nsna/tarka"
+
+// TracingConfig enables OpenTelemetry spans for provider calls and the HTTP
+// requests behind them, exported over OTLP/gRPC
+type TracingConfig struct {
+	// Endpoint of the OTLP collector, e.g. https://otel-collector:4317
+	// (defaults to the standard OTEL_EXPORTER_OTLP_* environment variables,
+	// as Caddy's own tracing does)
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// setupTracing creates the tracer provider spans are exported through
+func (p *Provider) setupTracing(ctx caddy.Context) error {
+	var opts []otlptracegrpc.Option
+	if p.Tracing.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpointURL(p.Tracing.Endpoint))
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	version, _ := caddy.Version()
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "caddy"),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	p.tracerProvider = tp
+	p.shutdownTracing = tp.Shutdown
+	return nil
+}
+
+// startSpan starts a span for a provider call on zone, recording the types
+// of the records involved. The domain ID is added once it is resolved.
+func (p *Provider) startSpan(ctx context.Context, name, zone string, records []libdns.Record) (context.Context, trace.Span) {
+	tp := p.tracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	attrs := []attribute.KeyValue{attribute.String("tarka.zone", zone)}
+	if types := recordTypes(records); len(types) > 0 {
+		attrs = append(attrs, attribute.StringSlice("tarka.record_types", types))
+	}
+	return tp.Tracer(tracerName).Start(ctx, "tarka."+name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// recordTypes returns the distinct types of records, sorted
+func recordTypes(records []libdns.Record) []string {
+	seen := make(map[string]bool)
+	var types []string
+	for _, record := range records {
+		recordType := record.RR().Type
+		if recordType != "" && !seen[recordType] {
+			seen[recordType] = true
+			types = append(types, recordType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
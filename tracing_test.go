@@ -0,0 +1,66 @@
+package tarka
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProvider_Tracing(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	p := newTestProvider(server.URL)
+	p.tracerProvider = tp
+
+	_, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token"},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	var parent tracetest.SpanStub
+	for _, span := range spans {
+		if span.Name == "tarka.AppendRecords" {
+			parent = span
+		}
+	}
+	if parent.Name == "" {
+		t.Fatalf("expected an AppendRecords span, got %d spans", len(spans))
+	}
+	attrs := make(map[string]string)
+	for _, kv := range parent.Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["tarka.zone"] != "example.com." || attrs["tarka.domain_id"] != "123" || attrs["tarka.record_types"] != `["TXT"]` {
+		t.Errorf("unexpected span attributes %v", attrs)
+	}
+
+	endpoints := make(map[string]bool)
+	for _, span := range spans {
+		if span.Parent.SpanID() == parent.SpanContext.SpanID() {
+			endpoints[span.Name] = true
+		}
+		// No span may carry credentials
+		for _, kv := range span.Attributes {
+			if strings.Contains(kv.Value.Emit(), tarkatest.Password) {
+				t.Errorf("span %s leaks the password in %s", span.Name, kv.Key)
+			}
+		}
+	}
+	if !endpoints["POST login.php"] || !endpoints["POST domain-rr-edit.php"] {
+		t.Errorf("expected HTTP spans under AppendRecords, got %v", endpoints)
+	}
+}
@@ -0,0 +1,46 @@
+package tarka
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nsna/tarka/client"
+)
+
+// TTL policies for values outside the range Tarka accepts
+const (
+	// TTLPolicyClamp raises or lowers out-of-range TTLs to the nearest limit
+	TTLPolicyClamp = "clamp"
+
+	// TTLPolicyReject fails the operation on an out-of-range TTL
+	TTLPolicyReject = "reject"
+)
+
+// effectiveTTL returns the TTL in seconds that a record with the requested
+// TTL is created with. A zero TTL takes the configured DefaultTTL, or
+// Tarka's own default; sub-second precision is rounded up to whole seconds;
+// and values outside Tarka's limits are clamped or rejected per TTLPolicy.
+func (p *Provider) effectiveTTL(ttl time.Duration) (int, error) {
+	if ttl <= 0 {
+		ttl = p.DefaultTTL
+	}
+	if ttl <= 0 {
+		return client.DefaultTTL, nil
+	}
+
+	// Compare as durations first so huge values can't overflow an int
+	minTTL := client.MinTTL * time.Second
+	maxTTL := client.MaxTTL * time.Second
+	if ttl >= minTTL && ttl <= maxTTL {
+		return int(math.Ceil(ttl.Seconds())), nil
+	}
+
+	if p.TTLPolicy == TTLPolicyReject {
+		return 0, fmt.Errorf("TTL %v is outside the range Tarka accepts (%v to %v)", ttl, minTTL, maxTTL)
+	}
+	if ttl < minTTL {
+		return client.MinTTL, nil
+	}
+	return client.MaxTTL, nil
+}
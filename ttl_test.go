@@ -0,0 +1,81 @@
+package tarka
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/nsna/tarka/internal/tarkatest"
+)
+
+func TestProvider_effectiveTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		defaultTTL time.Duration
+		policy     string
+		ttl        time.Duration
+		want       int
+		wantErr    bool
+	}{
+		{name: "unset uses Tarka default", ttl: 0, want: 3600},
+		{name: "unset uses configured default", defaultTTL: 5 * time.Minute, ttl: 0, want: 300},
+		{name: "in range", ttl: 2 * time.Minute, want: 120},
+		{name: "sub-second rounds up", ttl: 120*time.Second + 500*time.Millisecond, want: 121},
+		{name: "too small is clamped", ttl: 500 * time.Millisecond, want: 60},
+		{name: "too large is clamped", ttl: 1000 * time.Hour, want: 604800},
+		{name: "huge is clamped", ttl: time.Duration(1<<63 - 1), want: 604800},
+		{name: "too small is rejected", policy: TTLPolicyReject, ttl: 30 * time.Second, wantErr: true},
+		{name: "too large is rejected", policy: TTLPolicyReject, ttl: 30 * 24 * time.Hour, wantErr: true},
+		{name: "in range with reject policy", policy: TTLPolicyReject, ttl: time.Hour, want: 3600},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Provider{DefaultTTL: tc.defaultTTL, TTLPolicy: tc.policy}
+			got, err := p.effectiveTTL(tc.ttl)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got TTL %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect an error but got: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("expected TTL %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestProvider_AppendRecords_ReportsEffectiveTTL(t *testing.T) {
+	server := tarkatest.NewServer()
+	defer server.Close()
+	server.AddDomain("123", "example.com")
+
+	p := newTestProvider(server.URL)
+	appended, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token", TTL: 10 * time.Second},
+		libdns.TXT{Name: "other", Text: "token"},
+	})
+	if err != nil {
+		t.Fatalf("AppendRecords failed: %v", err)
+	}
+	if ttl := appended[0].RR().TTL; ttl != time.Minute {
+		t.Errorf("expected the clamped TTL of 1m to be reported, got %v", ttl)
+	}
+	if ttl := appended[1].RR().TTL; ttl != time.Hour {
+		t.Errorf("expected Tarka's default TTL of 1h to be reported, got %v", ttl)
+	}
+
+	p.TTLPolicy = TTLPolicyReject
+	_, err = p.AppendRecords(context.Background(), "example.com.", []libdns.Record{
+		libdns.TXT{Name: "_acme-challenge", Text: "token", TTL: 10 * time.Second},
+	})
+	if err == nil || !strings.Contains(err.Error(), "outside the range") {
+		t.Errorf("expected the TTL to be rejected, got: %v", err)
+	}
+}